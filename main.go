@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/taimoorgit/trashdb/trashdb"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+	"sigs.k8s.io/yaml"
 )
 
 var client *kubernetes.Clientset
@@ -24,7 +29,7 @@ func env(key, fallback string) string {
 	return value
 }
 
-func initKubernetesClient() *kubernetes.Clientset {
+func initKubernetesClient() (*kubernetes.Clientset, dynamic.Interface) {
 	var kubeconfig *string
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -44,21 +49,117 @@ func initKubernetesClient() *kubernetes.Clientset {
 	if err != nil {
 		panic(err)
 	}
-	return clientset
+
+	// the dynamic client is for TrashInstance objects
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	return clientset, dynamicClient
 }
 
-func startEventLoop(namespace string) {
+func startEventLoop(namespace string, controller bool) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		trashdb.ListPods(ctx, nil, namespace)
+		eventLoopPass(namespace, controller)
+	}
+}
+
+// eventLoopPass is one tick of the event loop, its own function so the contexts are released
+// at the end of every pass
+func eventLoopPass(namespace string, controller bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	trashdb.ListPods(ctx, nil, namespace)
+
+	deleteCtx, deleteCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer deleteCancel()
+	trashdb.DeleteExpiredPods(deleteCtx, namespace)
+
+	queueCtx, queueCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer queueCancel()
+	trashdb.ProcessWaitlist(queueCtx, namespace)
+
+	poolCtx, poolCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer poolCancel()
+	trashdb.RefillPool(poolCtx, namespace)
+
+	keysCtx, keysCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer keysCancel()
+	if err := trashdb.LoadAPIKeys(keysCtx, nil, namespace); err != nil {
+		log.Error().Err(err).Msg("Failed to reload API keys, keeping the old ones")
+	}
+	if err := trashdb.LoadJWTKeys(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload token keys, keeping the old ones")
+	}
+
+	if controller {
+		instanceCtx, instanceCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer instanceCancel()
+		trashdb.ReconcileTrashInstances(instanceCtx, namespace)
+	}
+}
+
+func startOrphanSweep(namespace string) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		trashdb.SweepOrphanedObjects(ctx, namespace)
+		cancel()
+	}
+}
+
+// apiKeyCommand generates an API key. The key is printed once, the store entry goes into the
+// keys file or Secret.
+//
+//	trashdb apikey -id ci -tenant team-a [-admin]
+func apiKeyCommand(args []string) {
+	flags := flag.NewFlagSet("apikey", flag.ExitOnError)
+	id := flags.String("id", "", "key id, shows up in logs and the audit log")
+	tenant := flags.String("tenant", "", "tenant the key belongs to")
+	admin := flags.Bool("admin", false, "let the key manage every tenant's instances")
+	flags.Parse(args)
+
+	key, entry, err := trashdb.NewAPIKey(*id, *tenant)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate API key")
+	}
+	entry.Admin = *admin
 
-		deleteCtx, deleteCancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer deleteCancel()
-		trashdb.DeleteExpiredPods(deleteCtx, namespace)
+	out, err := yaml.Marshal(map[string]any{"keys": []trashdb.APIKey{entry}})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to encode API key")
+	}
+	fmt.Printf("API key (shown only once): %s\n\nAdd this to the key store:\n%s", key, out)
+}
+
+// reapCommand runs a single reaper pass and prints the report, for cleaning up by hand
+//
+//	trashdb [-kubeconfig path] reap [-namespace trashdb] [-dry-run]
+func reapCommand(namespace string, args []string) {
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	ns := flags.String("namespace", namespace, "namespace to reap")
+	dryRun := flags.Bool("dry-run", false, "only report what would be deleted")
+	flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	report, err := trashdb.ReapOnce(ctx, *ns, *dryRun)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Reap failed")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if report.Failures > 0 {
+		os.Exit(1)
 	}
 }
 
@@ -66,10 +167,64 @@ func main() {
 	namespace := env("NAMESPACE", "trashdb")
 	port := env("PORT", "8080")
 
-	c := initKubernetesClient()
+	config, err := trashdb.LoadConfig(env("CONFIG_FILE", ""))
+	if err != nil {
+		panic(err)
+	}
+	trashdb.SetConfig(config)
+
+	// doesn't need the cluster, so it runs before connecting
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		apiKeyCommand(os.Args[2:])
+		return
+	}
+
+	shutdownTracing := trashdb.StartTracing(config.Tracing)
+	defer shutdownTracing()
+
+	closeAuditLog, err := trashdb.OpenAuditLog(config.Audit.Path)
+	if err != nil {
+		panic(err)
+	}
+	defer closeAuditLog()
+
+	c, d := initKubernetesClient()
 	trashdb.SetClient(c)
+	trashdb.SetDynamicClient(d)
+
+	recorder, flushEvents := trashdb.NewEventRecorder(c)
+	trashdb.SetEventRecorder(recorder)
+	defer flushEvents()
+
+	if flag.Arg(0) == "reap" {
+		reapCommand(namespace, flag.Args()[1:])
+		return
+	}
+
+	keysCtx, keysCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := trashdb.LoadAPIKeys(keysCtx, nil, namespace); err != nil {
+		panic(err)
+	}
+	keysCancel()
+	if err := trashdb.LoadJWTKeys(); err != nil {
+		panic(err)
+	}
+	caCtx, caCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := trashdb.LoadCA(caCtx, nil, namespace); err != nil {
+		panic(err)
+	}
+	caCancel()
+
+	// catch up on anything that expired while we were down before serving requests
+	reconcileCtx, reconcileCancel := context.WithTimeout(context.Background(), 60*time.Second)
+	if err := trashdb.ReconcilePods(reconcileCtx, namespace); err != nil {
+		log.Error().Err(err).Msg("Startup reconciliation failed, the event loop will retry")
+	}
+	reconcileCancel()
+
+	go startEventLoop(namespace, config.Controller.Enabled)
 
-	go startEventLoop(namespace)
+	go startOrphanSweep(namespace)
 
 	go trashdb.StartServer(port, namespace)
 
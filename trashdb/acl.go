@@ -0,0 +1,224 @@
+package trashdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Instances are public, so commands that reach outside the instance or take it down (CONFIG SET,
+// DEBUG, MODULE LOAD, REPLICAOF, SHUTDOWN, SAVE...) are taken away from clients with an ACL on
+// the default user. Clients running a blocked command get Redis' own NOPERM error naming it.
+//
+// The ACL lives in a Secret per pod that Redis reads as its aclfile. Clients log in as the default
+// user with the instance secret, TrashDB as its own admin user with a password only the Secret
+// knows. The file holds password hashes only, and only the file is mounted into the pod. Password
+// changes are applied live with ACL SETUSER and written to the Secret, so a restarted container
+// doesn't go back to an old password.
+
+const (
+	aclMountPath = "/acl"
+	aclFileKey   = "users.acl"
+	// adminPasswordKey is TrashDB's own password, it stays out of the pod
+	adminPasswordKey = "admin-password"
+	adminUser        = "trashdb"
+)
+
+// CommandRules are the commands a tier's clients can't run. Entries are command names, like
+// flushall or config|set for a subcommand, or categories like @dangerous.
+type CommandRules struct {
+	Deny []string `json:"deny"`
+	// Allow are exceptions to Deny
+	Allow []string `json:"allow"`
+}
+
+// defaultCommandRules apply to tiers without a deny list. Everything in @dangerous is out
+// except for what people expect to use on a scratch database.
+var defaultCommandRules = CommandRules{
+	Deny:  []string{"@dangerous"},
+	Allow: []string{"flushdb", "flushall", "keys", "info", "sort"},
+}
+
+var validCommandRule = regexp.MustCompile(`^@?[a-z][a-z0-9_-]*(\|[a-z][a-z0-9_-]*)?$`)
+
+// commandRules are the tier's rules, or the defaults if it has no deny list. An empty deny list
+// (deny: []) turns filtering off.
+func (t Tier) commandRules() CommandRules {
+	if t.Commands.Deny == nil {
+		return defaultCommandRules
+	}
+	return t.Commands
+}
+
+func (r CommandRules) validate() error {
+	for _, rule := range append(append([]string{}, r.Deny...), r.Allow...) {
+		if !validCommandRule.MatchString(rule) {
+			return fmt.Errorf("%q is not a lowercase command, command|subcommand or @category", rule)
+		}
+	}
+	return nil
+}
+
+// aclFile is the Redis ACL file for a pod. Later rules win in Redis ACLs, so allows come after
+// denies.
+func (r CommandRules) aclFile(password, adminPassword string) string {
+	rules := []string{"user", "default", "on", passwordHash(password), "~*", "&*", "+@all"}
+	for _, deny := range r.Deny {
+		rules = append(rules, "-"+deny)
+	}
+	for _, allow := range r.Allow {
+		rules = append(rules, "+"+allow)
+	}
+	admin := []string{"user", adminUser, "on", passwordHash(adminPassword), "~*", "&*", "+@all"}
+	return strings.Join(rules, " ") + "\n" + strings.Join(admin, " ") + "\n"
+}
+
+// passwordHash is a password in the form ACL rules take it without giving it away
+func passwordHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return "#" + hex.EncodeToString(sum[:])
+}
+
+// withDefaultPassword swaps the default user's password in an ACL file
+func withDefaultPassword(file, password string) string {
+	lines := strings.Split(file, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" || fields[1] != "default" {
+			continue
+		}
+		for j, field := range fields {
+			if strings.HasPrefix(field, "#") {
+				fields[j] = passwordHash(password)
+			}
+		}
+		lines[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func aclSecretName(podName string) string {
+	return podName + "-acl"
+}
+
+// WithACL has Redis read its users from the pod's ACL Secret
+func WithACL(podName string) PodOption {
+	return func(p *v1.Pod) {
+		p.Spec.Volumes = append(p.Spec.Volumes, v1.Volume{
+			Name: "acl",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+				SecretName:  aclSecretName(podName),
+				Items:       []v1.KeyToPath{{Key: aclFileKey, Path: aclFileKey}},
+				DefaultMode: ptrTo(int32(0o440)),
+			}},
+		})
+		for i := range p.Spec.Containers {
+			c := &p.Spec.Containers[i]
+			c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{Name: "acl", MountPath: aclMountPath, ReadOnly: true})
+			c.Args = append(c.Args, "--aclfile", aclMountPath+"/"+aclFileKey)
+		}
+	}
+}
+
+// ensureACL creates the pod's ACL Secret with a new admin password. A controller pod that is
+// recreated finds the Secret of the one before it, which is brought up to date.
+func ensureACL(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, tier Tier, password string) error {
+	adminPassword := generatePassword(30)
+	secret := &v1.Secret{
+		ObjectMeta: dependentMeta(namespace, aclSecretName(pod.Name), pod.Labels["app.trashdb/name"], rootOwner(pod)),
+		Type:       v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			aclFileKey:       []byte(tier.commandRules().aclFile(password, adminPassword)),
+			adminPasswordKey: []byte(adminPassword),
+		},
+	}
+	_, err := client.CreateSecret(ctx, namespace, secret)
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := client.GetSecret(ctx, namespace, secret.Name)
+	if err != nil {
+		return err
+	}
+	existing.Data = secret.Data
+	_, err = client.UpdateSecret(ctx, namespace, existing)
+	return err
+}
+
+// setEnginePassword changes the password clients log in to the engine with, live and in the ACL
+// Secret. A failed Secret update puts the old password back.
+func setEnginePassword(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, password string) error {
+	secret, err := client.GetSecret(ctx, namespace, aclSecretName(pod.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read ACL: %w", err)
+	}
+	oldHash := defaultPasswordHash(string(secret.Data[aclFileKey]))
+	if oldHash == "" {
+		return fmt.Errorf("ACL secret %s has no password for the default user", secret.Name)
+	}
+
+	if _, err := engineCommand(ctx, client, namespace, pod, "ACL", "SETUSER", "default", "resetpass", passwordHash(password)); err != nil {
+		return err
+	}
+	updated := secret.DeepCopy()
+	updated.Data[aclFileKey] = []byte(withDefaultPassword(string(secret.Data[aclFileKey]), password))
+	if _, err := client.UpdateSecret(ctx, namespace, updated); err != nil {
+		if _, revertErr := engineCommand(ctx, client, namespace, pod, "ACL", "SETUSER", "default", "resetpass", oldHash); revertErr != nil {
+			logger(ctx).Error().Err(revertErr).Str("pod", pod.Name).Msg("Failed to restore engine password")
+		}
+		return fmt.Errorf("failed to update ACL: %w", err)
+	}
+	return nil
+}
+
+func defaultPasswordHash(file string) string {
+	for _, line := range strings.Split(file, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" || fields[1] != "default" {
+			continue
+		}
+		for _, field := range fields {
+			if strings.HasPrefix(field, "#") {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// EngineCommandFunc runs a command on the engine in a pod as TrashDB's admin user and returns the
+// first line of the reply
+type EngineCommandFunc func(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, args ...string) (string, error)
+
+var engineCommand EngineCommandFunc = adminCommand
+
+// SetEngineCommand replaces how TrashDB talks to engines, so tests don't need a Redis. nil goes
+// back to connecting to the pod.
+func SetEngineCommand(f EngineCommandFunc) {
+	if f == nil {
+		f = adminCommand
+	}
+	engineCommand = f
+}
+
+func adminCommand(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, args ...string) (string, error) {
+	var user, password string
+	secret, err := client.GetSecret(ctx, namespace, aclSecretName(pod.Name))
+	switch {
+	case err == nil:
+		user, password = adminUser, string(secret.Data[adminPasswordKey])
+	case !apierrors.IsNotFound(err):
+		return "", fmt.Errorf("failed to read ACL: %w", err)
+	}
+	// pods from before ACL secrets have no passwords
+	addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(redisPort))
+	return redisCommand(ctx, addr, user, password, redisTLSConfig(pod), args...)
+}
@@ -0,0 +1,81 @@
+package trashdb_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+)
+
+func TestCommandRules(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		Commands      trashdb.CommandRules
+		ExpectedRules string
+		ExpectedErr   string
+	}{
+		{
+			Name:          "defaults",
+			ExpectedRules: "~* &* +@all -@dangerous +flushdb +flushall +keys +info +sort",
+		},
+		{
+			Name:          "custom",
+			Commands:      trashdb.CommandRules{Deny: []string{"@dangerous", "eval", "config|get"}, Allow: []string{"flushall"}},
+			ExpectedRules: "~* &* +@all -@dangerous -eval -config|get +flushall",
+		},
+		{
+			Name:          "filtering off",
+			Commands:      trashdb.CommandRules{Deny: []string{}},
+			ExpectedRules: "~* &* +@all",
+		},
+		{
+			Name:        "invalid rule",
+			Commands:    trashdb.CommandRules{Deny: []string{"+@all ~secret"}},
+			ExpectedErr: `tier "small": commands: "+@all ~secret" is not a lowercase command`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			config := trashdb.DefaultConfig()
+			tier := config.Tiers["small"]
+			tier.Commands = tc.Commands
+			config.Tiers["small"] = tier
+
+			err := config.Validate()
+			if tc.ExpectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.ExpectedErr) {
+					t.Fatalf("Expected error %q, got %v", tc.ExpectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			trashdb.SetConfig(config)
+			t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+			cluster := &fakeCluster{}
+			pod, err := trashdb.CreatePod(context.Background(), cluster.client(), "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if args := pod.Spec.Containers[0].Args; !slices.Contains(args, "--aclfile") {
+				t.Errorf("Expected Redis to read the ACL file, got args %v", args)
+			}
+
+			secret := findSecret(cluster, "pod-123-acl")
+			users := strings.Split(strings.TrimSpace(string(secret.Data["users.acl"])), "\n")
+			if len(users) != 2 || users[1] != "user trashdb on "+passwordHash(string(secret.Data["admin-password"]))+" ~* &* +@all" {
+				t.Fatalf("Expected the default user and TrashDB's admin user, got %q", users)
+			}
+			if diff := cmp.Diff("user default on "+passwordHash(exampleSecret)+" "+tc.ExpectedRules, users[0]); diff != "" {
+				t.Errorf("Rules mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
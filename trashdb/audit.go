@@ -0,0 +1,136 @@
+package trashdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The audit log is an append-only file with one JSON object per line for every create, extend,
+// secret rotation and delete: who asked, for which instance and how it went. It never contains
+// secrets. Deletes TrashDB makes on its own, by the reaper, the expiration policy or the orphan
+// sweep, name that part of TrashDB as the actor.
+
+const (
+	AuditCreate = "create"
+	AuditExtend = "extend"
+	AuditRotate = "rotate_secret"
+	AuditDelete = "delete"
+)
+
+// System actors of the audit log
+const (
+	ActorReaper           = "reaper"
+	ActorExpirationPolicy = "expiration-policy"
+	ActorOrphanSweep      = "orphan-sweep"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time      `json:"time"`
+	RequestID string         `json:"requestId,omitempty"`
+	Action    string         `json:"action"`
+	Actor     AuditActor     `json:"actor"`
+	PodName   string         `json:"podName"`
+	Outcome   string         `json:"outcome"`
+	Error     string         `json:"error,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+type AuditActor struct {
+	// System is set instead of the rest for actions TrashDB takes on its own
+	System   string `json:"system,omitempty"`
+	ClientIP string `json:"clientIp,omitempty"`
+	APIKeyID string `json:"apiKeyId,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+}
+
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var auditor *auditLog
+
+// OpenAuditLog starts appending audit entries to path. The returned function closes the file.
+func OpenAuditLog(path string) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	SetAuditWriter(file)
+	log.Info().Msgf("Writing audit log to %s", path)
+
+	return func() {
+		SetAuditWriter(nil)
+		file.Close()
+	}, nil
+}
+
+// SetAuditWriter sends audit entries to w, nil turns the audit log off
+func SetAuditWriter(w io.Writer) {
+	if w == nil {
+		auditor = nil
+		return
+	}
+	auditor = &auditLog{w: w}
+}
+
+// audit records an action taken on behalf of the request in ctx
+func audit(ctx context.Context, action, podName, outcome string, err error, details map[string]any) {
+	meta := requestMetaFrom(ctx)
+	writeAudit(ctx, AuditEntry{
+		RequestID: meta.RequestID,
+		Action:    action,
+		Actor:     AuditActor{ClientIP: meta.ClientIP, APIKeyID: meta.APIKeyID, Tenant: meta.Tenant, Subject: meta.Subject},
+		PodName:   podName,
+		Outcome:   outcome,
+		Details:   details,
+	}, err)
+}
+
+// auditSystem records an action TrashDB took on its own, actor is one of the Actor constants
+func auditSystem(ctx context.Context, actor, action, podName, outcome string, err error, details map[string]any) {
+	writeAudit(ctx, AuditEntry{
+		Action:  action,
+		Actor:   AuditActor{System: actor},
+		PodName: podName,
+		Outcome: outcome,
+		Details: details,
+	}, err)
+}
+
+func writeAudit(ctx context.Context, entry AuditEntry, err error) {
+	a := auditor
+	if a == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		logger(ctx).Error().Err(marshalErr).Msg("Failed to encode audit entry")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, writeErr := a.w.Write(append(line, '\n')); writeErr != nil {
+		logger(ctx).Error().Err(writeErr).Msg("Failed to write audit entry")
+	}
+}
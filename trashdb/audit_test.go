@@ -0,0 +1,157 @@
+package trashdb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	trashdb.SetAuditWriter(&buf)
+	t.Cleanup(func() { trashdb.SetAuditWriter(nil) })
+
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	ctx := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{RequestID: "req-1", ClientIP: "10.0.0.1"})
+
+	if _, _, err := trashdb.AdmitPod(ctx, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "10.0.0.1",
+		PodName:   "pod-123",
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+	}, false); err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+	if _, err := trashdb.ExtendPod(ctx, client, "namespace-123", "pod-123", "wrong-secret", 10*time.Minute); err == nil {
+		t.Fatalf("Expected extending with the wrong secret to fail")
+	}
+	if err := trashdb.DeletePodWithSecret(ctx, client, "namespace-123", "pod-123", exampleSecret); err != nil {
+		t.Fatalf("Unexpected error deleting pod: %v", err)
+	}
+
+	if strings.Contains(buf.String(), exampleSecret) || strings.Contains(buf.String(), "wrong-secret") {
+		t.Errorf("Audit log leaks a secret:\n%s", buf.String())
+	}
+
+	type line struct {
+		action, podName, outcome, requestID, clientIP string
+	}
+	var got []line
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry trashdb.AuditEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			t.Fatalf("Audit line isn't JSON: %v\n%s", err, raw)
+		}
+		got = append(got, line{entry.Action, entry.PodName, entry.Outcome, entry.RequestID, entry.Actor.ClientIP})
+	}
+
+	expected := []line{
+		{trashdb.AuditCreate, "pod-123", "success", "req-1", "10.0.0.1"},
+		{trashdb.AuditExtend, "pod-123", "invalid", "req-1", "10.0.0.1"},
+		{trashdb.AuditDelete, "pod-123", "success", "req-1", "10.0.0.1"},
+	}
+	if diff := cmp.Diff(expected, got, cmp.AllowUnexported(line{})); diff != "" {
+		t.Errorf("Audit log mismatch (-expected +got):\n%s", diff)
+	}
+}
+
+func TestAuditSystemDeletes(t *testing.T) {
+	var buf bytes.Buffer
+	trashdb.SetAuditWriter(&buf)
+	t.Cleanup(func() { trashdb.SetAuditWriter(nil) })
+
+	config := trashdb.DefaultConfig()
+	config.ExpirationPolicy.Action = trashdb.PolicyDelete
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	expired := trashdb.NewPod(
+		trashdb.WithName("expired"),
+		trashdb.WithAnnotations(map[string]string{"app.trashdb/expiration": time.Now().Add(-time.Minute).Format(time.RFC3339)}),
+	)
+	handMade := trashdb.NewPod(trashdb.WithName("hand-made"))
+	cluster := &fakeCluster{
+		pods: []v1.Pod{*expired, *handMade},
+		instances: []trashdb.TrashInstance{{
+			ObjectMeta: metav1.ObjectMeta{Name: "expired-instance", UID: "uid-expired-instance"},
+			Status:     trashdb.TrashInstanceStatus{ExpiresAt: &metav1.Time{Time: time.Now().Add(-time.Minute)}},
+		}},
+		dependents: map[string][]metav1.ObjectMeta{
+			"Service": {{
+				Name:              "redis-gone",
+				Labels:            map[string]string{"app.trashdb/name": "gone"},
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+			}},
+		},
+	}
+	client := cluster.client()
+	trashdb.Reap(context.Background(), client, "namespace-123", cluster.pods, false)
+	trashdb.SweepOrphans(context.Background(), client, "namespace-123")
+	trashdb.ReconcileInstances(context.Background(), client, "namespace-123")
+
+	type line struct {
+		action, podName, outcome, system string
+		reason                           any
+	}
+	var got []line
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry trashdb.AuditEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			t.Fatalf("Audit line isn't JSON: %v\n%s", err, raw)
+		}
+		got = append(got, line{entry.Action, entry.PodName, entry.Outcome, entry.Actor.System, entry.Details["reason"]})
+	}
+
+	expected := []line{
+		{trashdb.AuditDelete, "expired", "success", trashdb.ActorReaper, "expired"},
+		{trashdb.AuditDelete, "hand-made", "success", trashdb.ActorExpirationPolicy, "missing expiration"},
+		{trashdb.AuditDelete, "gone", "success", trashdb.ActorOrphanSweep, nil},
+		{trashdb.AuditDelete, "expired-instance", "success", trashdb.ActorReaper, "expired"},
+	}
+	if diff := cmp.Diff(expected, got, cmp.AllowUnexported(line{})); diff != "" {
+		t.Errorf("Audit log mismatch (-expected +got):\n%s", diff)
+	}
+}
+
+func TestReapSkipsTerminatingPods(t *testing.T) {
+	var buf bytes.Buffer
+	trashdb.SetAuditWriter(&buf)
+	t.Cleanup(func() { trashdb.SetAuditWriter(nil) })
+
+	terminating := trashdb.NewPod(
+		trashdb.WithName("terminating"),
+		trashdb.WithAnnotations(map[string]string{"app.trashdb/expiration": time.Now().Add(-time.Minute).Format(time.RFC3339)}),
+	)
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	deletes := 0
+	cluster := &fakeCluster{pods: []v1.Pod{*terminating}}
+	client := cluster.client()
+	deletePod := client.DeletePodFunc
+	client.DeletePodFunc = func(ctx context.Context, namespace, podName string) error {
+		deletes++
+		return deletePod(ctx, namespace, podName)
+	}
+	before := scrape(t)
+
+	report := trashdb.Reap(context.Background(), client, "namespace-123", cluster.pods, false)
+
+	if deletes != 0 || len(report.Candidates) != 0 {
+		t.Errorf("Expected the terminating pod to be left alone, got %d deletes and %v", deletes, report.Candidates)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no audit entries, got %s", buf.String())
+	}
+	series := `trashdb_deletes_total{reason="expired",result="success"}`
+	if after := scrape(t); after[series] != before[series] {
+		t.Errorf("Expected %s to stay at %v, got %v", series, before[series], after[series])
+	}
+}
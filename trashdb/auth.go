@@ -0,0 +1,381 @@
+package trashdb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// With auth enabled, API calls carry an API key in the X-API-Key header or a bearer token (see
+// jwt.go). Keys look like
+// "<id>.<secret>" and belong to a tenant, the store only has a SHA-256 hash of each key. The store
+// is a YAML file or a Secret, it is reloaded by the event loop so revoking or removing a key takes
+// effect within a few seconds.
+//
+// Instances are labeled with the tenant that created them and a tenant can only see and manage its
+// own. Calls without a key are anonymous, if that is allowed at all, and get stricter limits.
+
+const (
+	apiKeyHeader = "X-API-Key"
+	tenantLabel  = "app.trashdb/tenant"
+	// subjectAnnotation is who in the tenant created an instance, subjects can't go in labels
+	subjectAnnotation = "app.trashdb/subject"
+	// apiKeysSecretKey is where the key store lives in the Secret
+	apiKeysSecretKey = "keys.yaml"
+)
+
+// key IDs and tenants end up in labels and log lines
+var validAuthName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// APIKey is one entry of the key store
+type APIKey struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	// Hash is the hex SHA-256 of the whole key
+	Hash string `json:"hash"`
+	// Admin keys see and manage the instances of every tenant
+	Admin   bool `json:"admin,omitempty"`
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+type apiKeyFile struct {
+	Keys []APIKey `json:"keys"`
+}
+
+type apiKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+var apiKeys = &apiKeyStore{}
+
+var authFailuresTotal = newCounterVec("trashdb_auth_failures_total",
+	"Requests turned away by authentication, by reason: missing, invalid, revoked or expired.", "reason")
+
+// NewAPIKey generates a key for the tenant. The key is only ever shown once, the returned entry
+// is what goes into the key store.
+func NewAPIKey(id, tenant string) (string, APIKey, error) {
+	if !validAuthName.MatchString(id) {
+		return "", APIKey{}, fmt.Errorf("key id %q must be a lowercase DNS label", id)
+	}
+	if !validAuthName.MatchString(tenant) {
+		return "", APIKey{}, fmt.Errorf("tenant %q must be a lowercase DNS label", tenant)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := id + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return key, APIKey{ID: id, Tenant: tenant, Hash: hashAPIKey(key)}, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadAPIKeys (re)reads the key store from the file or Secret in the config. On failure the
+// keys loaded before stay in use.
+func LoadAPIKeys(ctx context.Context, client KubernetesClient, namespace string) error {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	var raw []byte
+	switch {
+	case config.Auth.KeysFile != "":
+		data, err := os.ReadFile(config.Auth.KeysFile)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys: %w", err)
+		}
+		raw = data
+	case config.Auth.KeysSecret != "":
+		secret, err := client.GetSecret(ctx, namespace, config.Auth.KeysSecret)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys: %w", err)
+		}
+		raw = secret.Data[apiKeysSecretKey]
+	default:
+		return nil
+	}
+
+	var file apiKeyFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	keys := map[string]APIKey{}
+	for _, key := range file.Keys {
+		if !validAuthName.MatchString(key.ID) || !validAuthName.MatchString(key.Tenant) {
+			return fmt.Errorf("API key %q: id and tenant must be lowercase DNS labels", key.ID)
+		}
+		if _, err := hex.DecodeString(key.Hash); err != nil || len(key.Hash) != sha256.Size*2 {
+			return fmt.Errorf("API key %q: hash must be a hex SHA-256", key.ID)
+		}
+		if _, ok := keys[key.ID]; ok {
+			return fmt.Errorf("API key %q is listed twice", key.ID)
+		}
+		keys[key.ID] = key
+	}
+
+	apiKeys.mu.Lock()
+	changed := len(keys) != len(apiKeys.keys)
+	apiKeys.keys = keys
+	apiKeys.mu.Unlock()
+	if changed {
+		log.Info().Msgf("Loaded %d API keys", len(keys))
+	}
+	return nil
+}
+
+// errUnauthorized is a 401, the reason is for metrics and the message for the caller
+type errUnauthorized struct {
+	reason  string
+	message string
+}
+
+func (e *errUnauthorized) Error() string {
+	return e.message
+}
+
+// LookupAPIKey finds the store entry for a key, revoked keys and wrong secrets are errors
+func LookupAPIKey(key string) (APIKey, error) {
+	id, _, ok := strings.Cut(key, ".")
+	if !ok {
+		return APIKey{}, &errUnauthorized{reason: "invalid", message: "invalid API key"}
+	}
+
+	apiKeys.mu.RLock()
+	entry, found := apiKeys.keys[id]
+	apiKeys.mu.RUnlock()
+
+	// hash anyway so unknown IDs take as long as wrong secrets
+	hash := hashAPIKey(key)
+	if !found || subtle.ConstantTimeCompare([]byte(hash), []byte(entry.Hash)) != 1 {
+		return APIKey{}, &errUnauthorized{reason: "invalid", message: "invalid API key"}
+	}
+	if entry.Revoked {
+		return APIKey{}, &errUnauthorized{reason: "revoked", message: "invalid API key"}
+	}
+	return entry, nil
+}
+
+// authenticated works out who is calling and turns away calls that aren't allowed. It runs
+// inside withRequestContext so it can fill in the request metadata.
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.Auth.Enabled {
+			handler(w, r)
+			return
+		}
+
+		key := r.Header.Get(apiKeyHeader)
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" && token == "" && websocket.IsWebSocketUpgrade(r) {
+			key, token = websocketCredentials(r)
+		}
+
+		meta := requestMetaFrom(r.Context())
+		var err error
+		switch {
+		case key != "":
+			var entry APIKey
+			if entry, err = LookupAPIKey(key); err == nil {
+				meta.APIKeyID = entry.ID
+				meta.Tenant = entry.Tenant
+				meta.Admin = entry.Admin
+			}
+		case token != "" && config.Auth.JWT.enabled():
+			var identity TokenIdentity
+			if identity, err = VerifyJWT(token); err == nil {
+				meta.Tenant = identity.Tenant
+				meta.Subject = identity.Subject
+			}
+		case config.Auth.Anonymous.Enabled:
+			handler(w, r)
+			return
+		default:
+			err = &errUnauthorized{reason: "missing", message: "API key or bearer token required"}
+		}
+
+		if err != nil {
+			reason := "invalid"
+			if unauthorized, ok := err.(*errUnauthorized); ok {
+				reason = unauthorized.reason
+			}
+			authFailuresTotal.WithLabelValues(reason).Inc()
+			logger(r.Context()).Warn().Str("reason", reason).Msg("Rejected credentials")
+			if token != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			sendResponse(w, http.StatusUnauthorized, err.Error(), nil)
+			return
+		}
+
+		logger(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+			if meta.APIKeyID != "" {
+				c = c.Str("apiKeyId", meta.APIKeyID)
+			}
+			if meta.Subject != "" {
+				c = c.Str("subject", meta.Subject)
+			}
+			return c.Str("tenant", meta.Tenant)
+		})
+		handler(w, r.WithContext(WithRequestMeta(r.Context(), meta)))
+	}
+}
+
+// Browsers can't set headers on websockets, and query parameters end up in access logs, so the
+// dashboard offers its key or token as a subprotocol next to websocketProtocol, which the server
+// picks.
+const (
+	websocketProtocol    = "trashdb"
+	websocketKeyPrefix   = "trashdb.key."
+	websocketTokenPrefix = "trashdb.token."
+)
+
+// websocketCredentials reads the key or token offered in Sec-WebSocket-Protocol
+func websocketCredentials(r *http.Request) (key, token string) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if value, ok := strings.CutPrefix(protocol, websocketKeyPrefix); ok {
+			key = value
+		} else if value, ok := strings.CutPrefix(protocol, websocketTokenPrefix); ok {
+			token = value
+		}
+	}
+	return key, token
+}
+
+// anonymous reports whether the call in ctx is held to the anonymous limits
+func anonymous(ctx context.Context) bool {
+	return config.Auth.Enabled && requestMetaFrom(ctx).Tenant == ""
+}
+
+// clientID is who per-client limits are counted against: the tenant with auth on, the IP otherwise
+func clientID(r *http.Request) string {
+	if !config.Auth.Enabled {
+		return ClientIP(r)
+	}
+	if tenant := requestMetaFrom(r.Context()).Tenant; tenant != "" {
+		return "tenant/" + tenant
+	}
+	return anonymousClientPrefix + ClientIP(r)
+}
+
+const anonymousClientPrefix = "anonymous/"
+
+// clientLimit is how many instances a client can have at once
+func clientLimit(clientID string) int {
+	if limit := config.Auth.Anonymous.MaxPerClient; limit > 0 && strings.HasPrefix(clientID, anonymousClientPrefix) {
+		return limit
+	}
+	return config.Capacity.MaxPerClient
+}
+
+// checkAnonymousCreate applies the tier and duration limits for anonymous creates
+func checkAnonymousCreate(ctx context.Context, tierName string, duration time.Duration) error {
+	if !anonymous(ctx) {
+		return nil
+	}
+	limits := config.Auth.Anonymous
+	if tierName == "" {
+		tierName = config.DefaultTier
+	}
+	if len(limits.Tiers) > 0 && !slices.Contains(limits.Tiers, tierName) {
+		return fmt.Errorf("anonymous instances can only use tiers %s", strings.Join(limits.Tiers, ", "))
+	}
+	if max := limits.MaxDuration.Duration; max > 0 && duration > max {
+		return fmt.Errorf("anonymous instances can live at most %d minutes", int(max.Minutes()))
+	}
+	return nil
+}
+
+// canAccess reports whether the caller in ctx may see the object. Anonymous callers share no
+// tenant, they only see what was created from their own address.
+func canAccess(ctx context.Context, object metav1.ObjectMeta) bool {
+	if !config.Auth.Enabled {
+		return true
+	}
+	meta := requestMetaFrom(ctx)
+	if meta.Admin {
+		return true
+	}
+	if object.Labels[tenantLabel] != meta.Tenant {
+		return false
+	}
+	return meta.Tenant != "" || object.Annotations["app.trashdb/client"] == anonymousClientPrefix+meta.ClientIP
+}
+
+// findOwnPod is findPod for the caller in ctx. Other tenants' pods look like they don't exist.
+func findOwnPod(ctx context.Context, client KubernetesClient, namespace, podName string) (*v1.Pod, error) {
+	pod, err := findPod(ctx, client, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	if !canAccess(ctx, pod.ObjectMeta) {
+		return nil, apierrors.NewNotFound(v1.Resource("pods"), podName)
+	}
+	return pod, nil
+}
+
+// visiblePods filters a pod list down to what the caller in ctx may see
+func visiblePods(ctx context.Context, pods *v1.PodList) *v1.PodList {
+	if pods == nil || !config.Auth.Enabled {
+		return pods
+	}
+	visible := &v1.PodList{ListMeta: pods.ListMeta}
+	for _, pod := range pods.Items {
+		if canAccess(ctx, pod.ObjectMeta) {
+			visible.Items = append(visible.Items, pod)
+		}
+	}
+	return visible
+}
+
+func WithTenant(tenant, subject string) PodOption {
+	return func(p *v1.Pod) {
+		if tenant != "" {
+			p.Labels[tenantLabel] = tenant
+		}
+		if subject != "" {
+			p.Annotations[subjectAnnotation] = subject
+		}
+	}
+}
+
+// visibleQueue is the waitlist, and the queued creates that failed, as the caller in ctx may see it
+func visibleQueue(ctx context.Context) []QueueEntry {
+	entries := append(waitlist.Queue(), waitlist.Failed()...)
+	if !config.Auth.Enabled {
+		return entries
+	}
+	visible := []QueueEntry{}
+	for _, entry := range entries {
+		if canAccess(ctx, metav1.ObjectMeta{
+			Labels:      map[string]string{tenantLabel: entry.tenant},
+			Annotations: map[string]string{"app.trashdb/client": entry.client},
+		}) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,152 @@
+package trashdb_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// withAPIKeys turns auth on with a key store holding the given entries
+func withAPIKeys(t *testing.T, keys ...trashdb.APIKey) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	raw, err := yaml.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := trashdb.DefaultConfig()
+	config.Auth.Enabled = true
+	config.Auth.KeysFile = path
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	if err := trashdb.LoadAPIKeys(context.Background(), &MockKubernetesClient{}, "namespace-123"); err != nil {
+		t.Fatalf("Unexpected error loading keys: %v", err)
+	}
+}
+
+func TestLookupAPIKey(t *testing.T) {
+	key, entry, err := trashdb.NewAPIKey("ci", "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, err := trashdb.NewAPIKey("old", "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Revoked = true
+	withAPIKeys(t, entry, revoked)
+
+	testCases := []struct {
+		Name           string
+		Key            string
+		ExpectedTenant string
+		ExpectError    bool
+	}{
+		{Name: "valid key", Key: key, ExpectedTenant: "team-a"},
+		{Name: "wrong secret", Key: "ci.not-the-secret", ExpectError: true},
+		{Name: "unknown id", Key: "nobody" + key[len("ci"):], ExpectError: true},
+		{Name: "no id", Key: "garbage", ExpectError: true},
+		{Name: "revoked key", Key: revokedKey, ExpectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := trashdb.LookupAPIKey(tc.Key)
+			if tc.ExpectError {
+				if err == nil {
+					t.Errorf("Expected an error, got key %q", got.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got.Tenant != tc.ExpectedTenant {
+				t.Errorf("Expected tenant %q, got %q", tc.ExpectedTenant, got.Tenant)
+			}
+		})
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	withAPIKeys(t)
+	cluster := &fakeCluster{}
+	client := cluster.client()
+
+	teamA := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{Tenant: "team-a"})
+	teamB := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{Tenant: "team-b"})
+	admin := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{Tenant: "ops", Admin: true})
+
+	if _, _, err := trashdb.AdmitPod(teamA, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "tenant/team-a",
+		Tenant:    "team-a",
+		PodName:   "pod-123",
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+	}, false); err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+	if tenant := cluster.pods[0].Labels["app.trashdb/tenant"]; tenant != "team-a" {
+		t.Errorf("Expected pod to be labeled with tenant team-a, got %q", tenant)
+	}
+
+	// another tenant can't tell the pod exists, even with the right secret
+	if _, err := trashdb.GetPod(teamB, client, "namespace-123", "pod-123"); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found for another tenant, got %v", err)
+	}
+	if _, err := trashdb.ExtendPod(teamB, client, "namespace-123", "pod-123", exampleSecret, 10*time.Minute); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found extending another tenant's pod, got %v", err)
+	}
+	if err := trashdb.DeletePodWithSecret(teamB, client, "namespace-123", "pod-123", exampleSecret); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found deleting another tenant's pod, got %v", err)
+	}
+	if _, err := trashdb.GetPod(context.Background(), client, "namespace-123", "pod-123"); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found for an anonymous caller, got %v", err)
+	}
+
+	if _, err := trashdb.GetPod(admin, client, "namespace-123", "pod-123"); err != nil {
+		t.Errorf("Expected admin to see every tenant's pods, got %v", err)
+	}
+	if err := trashdb.DeletePodWithSecret(teamA, client, "namespace-123", "pod-123", exampleSecret); err != nil {
+		t.Errorf("Unexpected error deleting own pod: %v", err)
+	}
+}
+
+func TestAnonymousIsolation(t *testing.T) {
+	withAPIKeys(t)
+	cluster := &fakeCluster{}
+	client := cluster.client()
+
+	first := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{ClientIP: "10.0.0.1"})
+	second := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{ClientIP: "10.0.0.2"})
+
+	if _, _, err := trashdb.AdmitPod(first, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "anonymous/10.0.0.1",
+		PodName:   "pod-123",
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+	}, false); err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+
+	// anonymous callers don't share a tenant, another address can't tell the pod exists
+	if _, err := trashdb.GetPod(second, client, "namespace-123", "pod-123"); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found for another anonymous caller, got %v", err)
+	}
+	if err := trashdb.DeletePodWithSecret(second, client, "namespace-123", "pod-123", exampleSecret); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found deleting another anonymous caller's pod, got %v", err)
+	}
+	if _, err := trashdb.GetPod(first, client, "namespace-123", "pod-123"); err != nil {
+		t.Errorf("Expected the creator to see its pod, got %v", err)
+	}
+}
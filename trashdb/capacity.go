@@ -0,0 +1,408 @@
+package trashdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CapacityError is returned when a create is turned away because a limit is reached
+type CapacityError struct {
+	Reason string
+}
+
+func (e *CapacityError) Error() string {
+	return e.Reason
+}
+
+var createsTotal = newCounterVec("trashdb_creates_total",
+	"Instance creates by result: success, failure, invalid, rejected (no capacity) or queued.", "result")
+
+// CreateRequest is everything needed to create an instance, kept around while it waits in the queue
+type CreateRequest struct {
+	ClientID  string
+	Tenant    string
+	Subject   string
+	PodName   string
+	PodSecret string
+	Tier      string
+	Duration  time.Duration
+	QueuedAt  time.Time
+	// Labels are extra pod labels, Owner is set for pods that belong to a TrashInstance
+	Labels map[string]string
+	Owner  *metav1.OwnerReference
+
+	// requester is the request metadata of a queued create, for the event once it's created
+	requester RequestMeta
+	// attempts counts queued creates that failed and were put back
+	attempts int
+}
+
+// QueueEntry is what the waitlist looks like from the outside, without secrets or client IDs.
+// Creates that came off the queue but failed for good are listed for a while with their error and
+// no position.
+type QueueEntry struct {
+	PodName  string     `json:"podName"`
+	Tier     string     `json:"tier"`
+	Position int        `json:"position,omitempty"`
+	QueuedAt time.Time  `json:"queuedAt"`
+	Error    string     `json:"error,omitempty"`
+	FailedAt *time.Time `json:"failedAt,omitempty"`
+
+	tenant string
+	client string
+}
+
+const (
+	// maxQueuedAttempts is how often a queued create is tried before it is given up on
+	maxQueuedAttempts = 5
+	// failedQueueTTL is how long given up creates stay in the queue status
+	failedQueueTTL  = 10 * time.Minute
+	failedQueueSize = 200
+)
+
+// Waitlist admits creates while there is capacity and queues them otherwise. An admitted create
+// reserves its slot and name under the lock, so two requests can't both take the last slot, and
+// runs outside it so a slow create doesn't hold up everyone else.
+type Waitlist struct {
+	mu     sync.Mutex
+	queue  []*CreateRequest
+	failed []QueueEntry
+	// reserved maps the names of creates in flight to their client
+	reserved map[string]string
+}
+
+var waitlist = &Waitlist{}
+
+// Admit creates the pod if there is room. When there isn't and queue is set, the request is put on
+// the waitlist and its 1-based position is returned instead of a pod.
+func (w *Waitlist) Admit(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest, queue bool) (*v1.Pod, int, error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	// catch bad requests now rather than when they come off the queue
+	if _, _, err := ValidateCreate(namespace, req.PodName, req.PodSecret, req.Tier, req.Duration); err != nil {
+		createDone(ctx, req, "invalid", err)
+		return nil, 0, err
+	}
+
+	w.mu.Lock()
+	if err := w.checkReserved(req.PodName); err != nil {
+		w.mu.Unlock()
+		createDone(ctx, req, "invalid", err)
+		return nil, 0, err
+	}
+
+	usage, err := w.usage(ctx, client, namespace)
+	if err != nil {
+		w.mu.Unlock()
+		createDone(ctx, req, "failure", err)
+		return nil, 0, err
+	}
+
+	// new arrivals don't get to jump ahead of anyone already waiting
+	err = checkCapacity(usage, req.ClientID)
+	if err == nil && w.hasRunnable(usage) {
+		err = &CapacityError{Reason: "instances are queued ahead of this request"}
+	}
+	if err == nil {
+		w.reserve(req)
+		w.mu.Unlock()
+
+		pod, outcome, err := createFromRequest(ctx, client, namespace, req)
+		createDone(ctx, req, outcome, err)
+		w.mu.Lock()
+		w.release(req)
+		w.mu.Unlock()
+		return pod, 0, err
+	}
+	defer w.mu.Unlock()
+	if !queue {
+		createDone(ctx, req, "rejected", err)
+		return nil, 0, err
+	}
+
+	if limit := config.Capacity.MaxQueued; limit > 0 && len(w.queue) >= limit {
+		err = &CapacityError{Reason: "waitlist is full"}
+		createDone(ctx, req, "rejected", err)
+		return nil, 0, err
+	}
+	if limit := clientLimit(req.ClientID); limit > 0 && w.queuedFor(req.ClientID) >= limit {
+		err = &CapacityError{Reason: fmt.Sprintf("client already has %d queued instances", limit)}
+		createDone(ctx, req, "rejected", err)
+		return nil, 0, err
+	}
+
+	req.QueuedAt = time.Now()
+	req.requester = requestMetaFrom(ctx)
+	w.queue = append(w.queue, &req)
+	createDone(ctx, req, "queued", nil)
+	logger(ctx).Info().Msgf("Queued pod creation at position %d", len(w.queue))
+	return nil, len(w.queue), nil
+}
+
+// Process creates queued instances in order as capacity frees up. A client that is at its own
+// limit is skipped so it can't hold up everyone behind it.
+func (w *Waitlist) Process(ctx context.Context, client KubernetesClient, namespace string) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.queue) == 0 {
+		return
+	}
+
+	usage, err := w.usage(ctx, client, namespace)
+	if err != nil {
+		return
+	}
+
+	remaining := w.queue[:0]
+	for _, req := range w.queue {
+		// whatever is left when the pass runs out of time waits for the next one
+		if ctx.Err() != nil || checkCapacity(usage, req.ClientID) != nil {
+			remaining = append(remaining, req)
+			continue
+		}
+
+		reqCtx := queuedContext(ctx, req)
+		if err := w.checkReserved(req.PodName); err != nil {
+			createDone(reqCtx, *req, "invalid", err)
+			w.fail(req, err)
+			continue
+		}
+		if _, outcome, err := createFromRequest(reqCtx, client, namespace, *req); err != nil {
+			req.attempts++
+			if retryableCreateError(err) && req.attempts < maxQueuedAttempts {
+				logger(reqCtx).Warn().Err(err).Msgf("Failed to create queued pod, will retry (attempt %d of %d)", req.attempts, maxQueuedAttempts)
+				remaining = append(remaining, req)
+				continue
+			}
+			logger(reqCtx).Error().Err(err).Msg("Failed to create queued pod, giving up")
+			createDone(reqCtx, *req, outcome, err)
+			w.fail(req, err)
+			continue
+		}
+		createDone(reqCtx, *req, "success", nil)
+		logger(reqCtx).Info().Msgf("Created queued pod after waiting %s", time.Since(req.QueuedAt).Round(time.Second))
+		usage.total++
+		usage.perClient[req.ClientID]++
+	}
+	w.queue = remaining
+}
+
+// retryableCreateError reports whether a create might work if it is tried again later
+func retryableCreateError(err error) bool {
+	var capacityErr *CapacityError
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		errors.As(err, &capacityErr) || errors.As(err, &netErr) ||
+		apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsConflict(err)
+}
+
+// fail remembers a queued create that was given up on, so its client can find out why
+func (w *Waitlist) fail(req *CreateRequest, err error) {
+	now := time.Now()
+	w.failed = append(w.failed, QueueEntry{
+		PodName:  req.PodName,
+		Tier:     req.Tier,
+		QueuedAt: req.QueuedAt,
+		Error:    err.Error(),
+		FailedAt: &now,
+		tenant:   req.Tenant,
+		client:   req.ClientID,
+	})
+	if len(w.failed) > failedQueueSize {
+		w.failed = w.failed[len(w.failed)-failedQueueSize:]
+	}
+}
+
+// Queue returns a snapshot of the waitlist in order
+func (w *Waitlist) Queue() []QueueEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entries := make([]QueueEntry, len(w.queue))
+	for i, req := range w.queue {
+		entries[i] = QueueEntry{
+			PodName:  req.PodName,
+			Tier:     req.Tier,
+			Position: i + 1,
+			QueuedAt: req.QueuedAt,
+			tenant:   req.Tenant,
+			client:   req.ClientID,
+		}
+	}
+	return entries
+}
+
+// Failed returns the queued creates that were given up on recently
+func (w *Waitlist) Failed() []QueueEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recent := w.failed[:0]
+	for _, entry := range w.failed {
+		if time.Since(*entry.FailedAt) < failedQueueTTL {
+			recent = append(recent, entry)
+		}
+	}
+	w.failed = recent
+	return append([]QueueEntry{}, recent...)
+}
+
+// usage counts the instances in the cluster and the creates in flight
+func (w *Waitlist) usage(ctx context.Context, client KubernetesClient, namespace string) (instanceUsage, error) {
+	usage, err := countInstances(ctx, client, namespace)
+	if err != nil {
+		return usage, err
+	}
+	// a create that just finished may be counted twice until it is released, which errs on the safe side
+	for _, clientID := range w.reserved {
+		usage.total++
+		usage.perClient[clientID]++
+	}
+	return usage, nil
+}
+
+// checkReserved fails for a name an admitted create is still working on, it isn't on a pod yet
+func (w *Waitlist) checkReserved(podName string) error {
+	if _, ok := w.reserved[podName]; ok {
+		return fmt.Errorf("pod name %q is already taken", podName)
+	}
+	return nil
+}
+
+func (w *Waitlist) reserve(req CreateRequest) {
+	if w.reserved == nil {
+		w.reserved = map[string]string{}
+	}
+	w.reserved[req.PodName] = req.ClientID
+}
+
+func (w *Waitlist) release(req CreateRequest) {
+	delete(w.reserved, req.PodName)
+}
+
+// hasRunnable reports whether anyone on the queue could be created right now
+func (w *Waitlist) hasRunnable(usage instanceUsage) bool {
+	for _, req := range w.queue {
+		if checkCapacity(usage, req.ClientID) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Waitlist) queuedFor(clientID string) int {
+	var n int
+	for _, req := range w.queue {
+		if req.ClientID == clientID {
+			n++
+		}
+	}
+	return n
+}
+
+func AdmitPod(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest, queue bool) (*v1.Pod, int, error) {
+	return waitlist.Admit(ctx, client, namespace, req, queue)
+}
+
+func ProcessWaitlist(ctx context.Context, namespace string) {
+	waitlist.Process(ctx, nil, namespace)
+}
+
+type instanceUsage struct {
+	total     int
+	perClient map[string]int
+}
+
+// countInstances asks the API server directly, the pod cache can be a few seconds behind
+func countInstances(ctx context.Context, client KubernetesClient, namespace string) (instanceUsage, error) {
+	pods, err := client.ListPods(ctx, namespace, metav1.ListOptions{
+		LabelSelector: managedBySelector,
+	})
+	if err != nil {
+		logger(ctx).Error().Err(err).Msg("Failed to list pods for capacity check")
+		return instanceUsage{}, err
+	}
+
+	usage := instanceUsage{perClient: map[string]int{}}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || isIdlePoolPod(pod) {
+			continue
+		}
+		usage.total++
+		usage.perClient[pod.Annotations["app.trashdb/client"]]++
+	}
+	return usage, nil
+}
+
+func checkCapacity(usage instanceUsage, clientID string) error {
+	if limit := config.Capacity.MaxInstances; limit > 0 && usage.total >= limit {
+		return &CapacityError{Reason: fmt.Sprintf("all %d instances are in use", limit)}
+	}
+	if limit := clientLimit(clientID); limit > 0 && usage.perClient[clientID] >= limit {
+		return &CapacityError{Reason: fmt.Sprintf("client already has %d instances", limit)}
+	}
+	return nil
+}
+
+// createDone counts and audits how a create turned out
+func createDone(ctx context.Context, req CreateRequest, outcome string, err error) {
+	createsTotal.WithLabelValues(outcome).Inc()
+	audit(ctx, AuditCreate, req.PodName, outcome, err, map[string]any{
+		"tier":     req.Tier,
+		"duration": req.Duration.String(),
+		"queued":   !req.QueuedAt.IsZero(),
+	})
+}
+
+// createFromRequest creates the instance, from the pool if it can. The outcome is left to the
+// caller to record, a queued create may be tried again.
+func createFromRequest(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest) (*v1.Pod, string, error) {
+	if taken, err := nameTaken(ctx, client, namespace, req.PodName); err != nil {
+		return nil, "failure", err
+	} else if taken {
+		return nil, "invalid", fmt.Errorf("pod name %q is already taken", req.PodName)
+	}
+
+	pod, err := pool.Claim(ctx, client, namespace, req)
+	if err != nil {
+		return nil, "failure", err
+	}
+	if pod != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			pool.Refill(ctx, client, namespace)
+		}()
+	} else {
+		pod, err = CreatePod(ctx, client, namespace, req.PodName, req.PodSecret, req.Tier, req.Duration,
+			WithLabels(userLabels(req.Labels)),
+			WithTenant(req.Tenant, req.Subject),
+			WithAnnotations(map[string]string{
+				"app.trashdb/client": req.ClientID,
+			}),
+			WithOwner(req.Owner))
+		if err != nil {
+			return nil, "failure", err
+		}
+	}
+
+	recordEvent(ctx, pod, v1.EventTypeNormal, EventCreated, "Created %s instance %s, expires at %s",
+		pod.Labels["app.trashdb/tier"], req.PodName, pod.Annotations["app.trashdb/expiration"])
+	return pod, "success", nil
+}
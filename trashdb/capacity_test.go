@@ -0,0 +1,432 @@
+package trashdb_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeCluster is an in-memory namespace that keeps pods and other objects around between calls
+type fakeCluster struct {
+	pods       []v1.Pod
+	dependents map[string][]metav1.ObjectMeta
+	secrets    []v1.Secret
+	policies   []networkingv1.NetworkPolicy
+	instances  []trashdb.TrashInstance
+}
+
+func (f *fakeCluster) client() *MockKubernetesClient {
+	return NewMockKubernetesClient(
+		WithCreatePodFunc(func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+			if pod.Name == "" {
+				pod.Name = fmt.Sprintf("%s%d", pod.GenerateName, len(f.pods))
+			}
+			f.pods = append(f.pods, *pod)
+			return pod, nil
+		}),
+		WithUpdatePodFunc(func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+			for i := range f.pods {
+				if f.pods[i].Name == pod.Name {
+					f.pods[i] = *pod
+				}
+			}
+			return pod, nil
+		}),
+		WithListPodsFunc(func(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error) {
+			selector, err := labels.Parse(listOptions.LabelSelector)
+			if err != nil {
+				return nil, err
+			}
+			list := &v1.PodList{}
+			for _, pod := range f.pods {
+				if selector.Matches(labels.Set(pod.Labels)) {
+					list.Items = append(list.Items, pod)
+				}
+			}
+			return list, nil
+		}),
+		WithGetPodFunc(func(ctx context.Context, namespace, podName string) (*v1.Pod, error) {
+			for _, pod := range f.pods {
+				if pod.Name == podName {
+					return &pod, nil
+				}
+			}
+			return nil, apierrors.NewNotFound(v1.Resource("pods"), podName)
+		}),
+		WithDeletePodFunc(func(ctx context.Context, namespace, podName string) error {
+			for i := range f.pods {
+				if f.pods[i].Name == podName {
+					f.pods = append(f.pods[:i], f.pods[i+1:]...)
+					return nil
+				}
+			}
+			return apierrors.NewNotFound(v1.Resource("pods"), podName)
+		}),
+		WithListDependentsFunc(func(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+			return f.dependents[kind], nil
+		}),
+		WithDeleteDependentFunc(func(ctx context.Context, namespace, kind, name string) error {
+			objects := f.dependents[kind]
+			for i := range objects {
+				if objects[i].Name == name {
+					f.dependents[kind] = append(objects[:i], objects[i+1:]...)
+					return nil
+				}
+			}
+			return apierrors.NewNotFound(v1.Resource(kind), name)
+		}),
+		WithListResourceQuotasFunc(noQuotas),
+		WithCreateServiceFunc(func(ctx context.Context, namespace string, service *v1.Service) (*v1.Service, error) {
+			f.addDependent("Service", service.ObjectMeta)
+			return service, nil
+		}),
+		WithCreateSecretFunc(func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+			f.addDependent("Secret", secret.ObjectMeta)
+			f.secrets = append(f.secrets, *secret)
+			return secret, nil
+		}),
+		WithCreateNetworkPolicyFunc(func(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error) {
+			f.addDependent("NetworkPolicy", policy.ObjectMeta)
+			f.policies = append(f.policies, *policy)
+			return policy, nil
+		}),
+		WithGetSecretFunc(func(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+			for _, secret := range f.secrets {
+				if secret.Name == name {
+					return &secret, nil
+				}
+			}
+			return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
+		}),
+		WithUpdateSecretFunc(func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+			for i := range f.secrets {
+				if f.secrets[i].Name == secret.Name {
+					f.secrets[i] = *secret
+					return secret, nil
+				}
+			}
+			return nil, apierrors.NewNotFound(v1.Resource("secrets"), secret.Name)
+		}),
+		WithListInstancesFunc(func(ctx context.Context, namespace string) ([]trashdb.TrashInstance, error) {
+			return append([]trashdb.TrashInstance{}, f.instances...), nil
+		}),
+		WithGetInstanceFunc(func(ctx context.Context, namespace, name string) (*trashdb.TrashInstance, error) {
+			for _, instance := range f.instances {
+				if instance.Name == name {
+					return &instance, nil
+				}
+			}
+			return nil, apierrors.NewNotFound(trashdb.TrashInstanceGVR.GroupResource(), name)
+		}),
+		WithCreateInstanceFunc(func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error) {
+			instance.UID = types.UID("uid-" + instance.Name)
+			f.instances = append(f.instances, *instance)
+			return instance, nil
+		}),
+		WithUpdateInstanceStatusFunc(func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error) {
+			for i := range f.instances {
+				if f.instances[i].Name == instance.Name {
+					f.instances[i].Status = instance.Status
+				}
+			}
+			return instance, nil
+		}),
+		WithDeleteInstanceFunc(func(ctx context.Context, namespace, name string) error {
+			for i := range f.instances {
+				if f.instances[i].Name == name {
+					f.collectGarbage(f.instances[i].UID)
+					f.instances = append(f.instances[:i], f.instances[i+1:]...)
+					return nil
+				}
+			}
+			return apierrors.NewNotFound(trashdb.TrashInstanceGVR.GroupResource(), name)
+		}),
+	)
+}
+
+func (f *fakeCluster) addDependent(kind string, object metav1.ObjectMeta) {
+	if f.dependents == nil {
+		f.dependents = map[string][]metav1.ObjectMeta{}
+	}
+	f.dependents[kind] = append(f.dependents[kind], object)
+}
+
+// collectGarbage does what the garbage collector does when an owner goes away
+func (f *fakeCluster) collectGarbage(owner types.UID) {
+	owned := func(object metav1.ObjectMeta) bool {
+		for _, ref := range object.OwnerReferences {
+			if ref.UID == owner {
+				return true
+			}
+		}
+		return false
+	}
+
+	var pods []v1.Pod
+	for _, pod := range f.pods {
+		if !owned(pod.ObjectMeta) {
+			pods = append(pods, pod)
+		}
+	}
+	f.pods = pods
+
+	for kind, objects := range f.dependents {
+		var kept []metav1.ObjectMeta
+		for _, object := range objects {
+			if !owned(object) {
+				kept = append(kept, object)
+			}
+		}
+		f.dependents[kind] = kept
+	}
+}
+
+func createRequest(clientID string, i int) trashdb.CreateRequest {
+	return trashdb.CreateRequest{
+		ClientID:  clientID,
+		PodName:   fmt.Sprintf("pod-%s-%d", clientID, i),
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+	}
+}
+
+func withCapacity(t *testing.T, capacity trashdb.CapacityConfig) {
+	config := trashdb.DefaultConfig()
+	config.Capacity = capacity
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+}
+
+func TestWaitlistAdmit(t *testing.T) {
+	type testCase struct {
+		Name         string
+		Capacity     trashdb.CapacityConfig
+		Existing     []string
+		ClientID     string
+		Queue        bool
+		ExpectedPos  int
+		ExpectedErr  string
+		ExpectCreate bool
+	}
+	testCases := []testCase{
+		{
+			Name:         "Room available",
+			Capacity:     trashdb.CapacityConfig{MaxInstances: 2, MaxPerClient: 2},
+			Existing:     []string{"a"},
+			ClientID:     "a",
+			ExpectCreate: true,
+		},
+		{
+			Name:        "Global limit reached",
+			Capacity:    trashdb.CapacityConfig{MaxInstances: 2},
+			Existing:    []string{"a", "b"},
+			ClientID:    "c",
+			ExpectedErr: "all 2 instances are in use",
+		},
+		{
+			Name:        "Client limit reached",
+			Capacity:    trashdb.CapacityConfig{MaxPerClient: 1},
+			Existing:    []string{"a"},
+			ClientID:    "a",
+			ExpectedErr: "client already has 1 instances",
+		},
+		{
+			Name:        "Global limit reached - queued",
+			Capacity:    trashdb.CapacityConfig{MaxInstances: 1},
+			Existing:    []string{"a"},
+			ClientID:    "b",
+			Queue:       true,
+			ExpectedPos: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			withCapacity(t, tc.Capacity)
+
+			cluster := &fakeCluster{}
+			for i, clientID := range tc.Existing {
+				cluster.pods = append(cluster.pods, *trashdb.NewPod(
+					trashdb.WithName(fmt.Sprintf("existing-%d", i)),
+					trashdb.WithAnnotations(map[string]string{"app.trashdb/client": clientID}),
+				))
+			}
+
+			waitlist := &trashdb.Waitlist{}
+			pod, pos, err := waitlist.Admit(context.Background(), cluster.client(), "namespace-123", createRequest(tc.ClientID, 0), tc.Queue)
+
+			if tc.ExpectedErr != "" {
+				if err == nil || err.Error() != tc.ExpectedErr {
+					t.Errorf("Expected error %q, got %v", tc.ExpectedErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if (pod != nil) != tc.ExpectCreate {
+				t.Errorf("Expected create %v, got pod %v", tc.ExpectCreate, pod)
+			}
+			if pos != tc.ExpectedPos {
+				t.Errorf("Expected queue position %d, got %d", tc.ExpectedPos, pos)
+			}
+		})
+	}
+}
+
+func TestWaitlistProcessIsFair(t *testing.T) {
+	withCapacity(t, trashdb.CapacityConfig{MaxInstances: 3, MaxPerClient: 2})
+
+	cluster := &fakeCluster{}
+	waitlist := &trashdb.Waitlist{}
+	client := cluster.client()
+
+	// client a fills its own limit and queues one more, b arrives after it
+	requests := []trashdb.CreateRequest{
+		createRequest("a", 0),
+		createRequest("a", 1),
+		createRequest("a", 2),
+		createRequest("b", 0),
+	}
+	for _, req := range requests {
+		if _, _, err := waitlist.Admit(context.Background(), client, "namespace-123", req, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	waitlist.Process(context.Background(), client, "namespace-123")
+
+	// b doesn't wait behind a's queued request since a can't run anyway
+	var got []string
+	for _, entry := range waitlist.Queue() {
+		got = append(got, entry.PodName)
+	}
+	if diff := cmp.Diff([]string{"pod-a-2"}, got); diff != "" {
+		t.Errorf("Queue mismatch (-expected +got):\n%s", diff)
+	}
+	if len(cluster.pods) != 3 {
+		t.Errorf("Expected 3 pods, got %d", len(cluster.pods))
+	}
+}
+
+func TestWaitlistProcessFailures(t *testing.T) {
+	withCapacity(t, trashdb.CapacityConfig{MaxInstances: 1})
+
+	cluster := &fakeCluster{}
+	waitlist := &trashdb.Waitlist{}
+	client := cluster.client()
+	for _, req := range []trashdb.CreateRequest{createRequest("a", 0), createRequest("b", 0), createRequest("c", 0)} {
+		if _, _, err := waitlist.Admit(context.Background(), client, "namespace-123", req, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// capacity frees up, but b runs into an API server hiccup and c into something that won't go away
+	cluster.pods = nil
+	client.CreatePodFunc = func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+		if pod.Name == "pod-b-0" {
+			return nil, apierrors.NewServiceUnavailable("etcd is down")
+		}
+		return nil, apierrors.NewForbidden(v1.Resource("pods"), pod.Name, fmt.Errorf("denied by admission webhook"))
+	}
+
+	queued := func() []string {
+		var names []string
+		for _, entry := range waitlist.Queue() {
+			names = append(names, entry.PodName)
+		}
+		return names
+	}
+	failed := func() []string {
+		var names []string
+		for _, entry := range waitlist.Failed() {
+			if entry.Error == "" || entry.FailedAt == nil {
+				t.Errorf("Expected %s to say why it failed, got %+v", entry.PodName, entry)
+			}
+			names = append(names, entry.PodName)
+		}
+		return names
+	}
+
+	var audit bytes.Buffer
+	trashdb.SetAuditWriter(&audit)
+	t.Cleanup(func() { trashdb.SetAuditWriter(nil) })
+	before := scrape(t)
+
+	waitlist.Process(context.Background(), client, "namespace-123")
+	if diff := cmp.Diff([]string{"pod-b-0"}, queued()); diff != "" {
+		t.Errorf("Queue mismatch (-expected +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"pod-c-0"}, failed()); diff != "" {
+		t.Errorf("Failed mismatch (-expected +got):\n%s", diff)
+	}
+
+	// a retryable error is only retried so often
+	for range 4 {
+		waitlist.Process(context.Background(), client, "namespace-123")
+	}
+	if got := queued(); len(got) != 0 {
+		t.Errorf("Expected the queue to be empty, got %v", got)
+	}
+	if diff := cmp.Diff([]string{"pod-c-0", "pod-b-0"}, failed()); diff != "" {
+		t.Errorf("Failed mismatch (-expected +got):\n%s", diff)
+	}
+
+	// retries aren't outcomes, each create is counted and audited once when it is given up on
+	series := `trashdb_creates_total{result="failure"}`
+	if after := scrape(t); after[series] != before[series]+2 {
+		t.Errorf("Expected %s to go up by 2, went from %v to %v", series, before[series], after[series])
+	}
+	if lines := strings.Count(audit.String(), `"outcome":"failure"`); lines != 2 {
+		t.Errorf("Expected 2 failed creates in the audit log, got %d:\n%s", lines, audit.String())
+	}
+}
+
+func TestWaitlistAdmitReserves(t *testing.T) {
+	withCapacity(t, trashdb.CapacityConfig{MaxInstances: 1})
+
+	cluster := &fakeCluster{}
+	waitlist := &trashdb.Waitlist{}
+	client := cluster.client()
+	createPod := client.CreatePodFunc
+	started, finish := make(chan struct{}), make(chan struct{})
+	client.CreatePodFunc = func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+		close(started)
+		<-finish
+		return createPod(ctx, namespace, pod)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := waitlist.Admit(context.Background(), client, "namespace-123", createRequest("a", 0), false)
+		done <- err
+	}()
+	<-started
+
+	// the slot and the name are taken while the first create is still running, without waiting on it
+	if _, _, err := waitlist.Admit(context.Background(), client, "namespace-123", createRequest("b", 0), false); err == nil || err.Error() != "all 1 instances are in use" {
+		t.Errorf("Expected the reserved slot to be in use, got %v", err)
+	}
+	taken := createRequest("b", 0)
+	taken.PodName = "pod-a-0"
+	if _, _, err := waitlist.Admit(context.Background(), client, "namespace-123", taken, false); err == nil || err.Error() != `pod name "pod-a-0" is already taken` {
+		t.Errorf("Expected the reserved name to be taken, got %v", err)
+	}
+
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cluster.pods) != 1 {
+		t.Errorf("Expected 1 pod, got %d", len(cluster.pods))
+	}
+}
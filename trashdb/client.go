@@ -2,10 +2,14 @@ package trashdb
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -16,40 +20,297 @@ func SetClient(c *kubernetes.Clientset) {
 	client = c
 }
 
+// dynamicClient talks to the TrashInstance custom resource, which has no typed client
+var dynamicClient dynamic.Interface
+
+func SetDynamicClient(c dynamic.Interface) {
+	dynamicClient = c
+}
+
 var podsCache *v1.PodList
 
+// podsCacheUpdated is when the event loop last refreshed the cache
+var podsCacheUpdated time.Time
+
+var (
+	_ = newGaugeFunc("trashdb_pods_cache_age_seconds", "Seconds since the pod cache was last refreshed.", podsCacheAge)
+	_ = newGaugeFunc("trashdb_active_instances", "Instances in the pod cache, not counting idle pool pods.", activeInstances, "engine", "tier")
+)
+
 // TODO: a diff output would be nice here, but can't do it easily because of metadata changing constantly...
 func UpdatePodsCache(pods *v1.PodList) {
+	podsCacheUpdated = time.Now()
 	if podsCache == nil {
 		log.Info().Msg("Initializing pod cache")
 		podsCache = pods
 		return
 	}
 	log.Info().Msg("Updating pod cache")
+	recordTransitions(podsCache, pods)
 	podsCache = pods
 }
 
+// instancePods is the pod cache without idle pool pods, which aren't anyone's instance yet
+func instancePods() *v1.PodList {
+	if podsCache == nil {
+		return nil
+	}
+	pods := &v1.PodList{ListMeta: podsCache.ListMeta}
+	for _, pod := range podsCache.Items {
+		if !isIdlePoolPod(pod) {
+			pods.Items = append(pods.Items, pod)
+		}
+	}
+	return pods
+}
+
+func podsCacheAge() map[string]float64 {
+	if podsCache == nil {
+		return nil
+	}
+	return map[string]float64{labelKey(): time.Since(podsCacheUpdated).Seconds()}
+}
+
+func activeInstances() map[string]float64 {
+	counts := map[string]float64{}
+	if pods := instancePods(); pods != nil {
+		for _, pod := range pods.Items {
+			counts[labelKey(pod.Labels["app.kubernetes.io/name"], pod.Labels["app.trashdb/tier"])]++
+		}
+	}
+	return counts
+}
+
 type KubernetesClient interface {
 	CreatePod(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)
+	UpdatePod(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)
 	ListPods(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error)
 	DeletePod(ctx context.Context, namespace, podName string) error
 	GetPod(ctx context.Context, namespace, podName string) (*v1.Pod, error)
+	ListResourceQuotas(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error)
+	ListDependents(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) ([]metav1.ObjectMeta, error)
+	DeleteDependent(ctx context.Context, namespace, kind, name string) error
+	CreateService(ctx context.Context, namespace string, service *v1.Service) (*v1.Service, error)
+	CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)
+	CreateNetworkPolicy(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error)
+	GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)
+	ListInstances(ctx context.Context, namespace string) ([]TrashInstance, error)
+	GetInstance(ctx context.Context, namespace, name string) (*TrashInstance, error)
+	CreateInstance(ctx context.Context, namespace string, instance *TrashInstance) (*TrashInstance, error)
+	UpdateInstanceStatus(ctx context.Context, namespace string, instance *TrashInstance) (*TrashInstance, error)
+	DeleteInstance(ctx context.Context, namespace, name string) error
 }
 
 type RealKubernetesClient struct{}
 
-func (c *RealKubernetesClient) CreatePod(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+func (c *RealKubernetesClient) CreatePod(ctx context.Context, namespace string, pod *v1.Pod) (_ *v1.Pod, err error) {
+	ctx, span := startClientSpan(ctx, "CreatePod", namespace, pod.Name)
+	defer finishSpan(span, &err)
+
 	return client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
 }
 
-func (c *RealKubernetesClient) ListPods(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error) {
+func (c *RealKubernetesClient) UpdatePod(ctx context.Context, namespace string, pod *v1.Pod) (_ *v1.Pod, err error) {
+	ctx, span := startClientSpan(ctx, "UpdatePod", namespace, pod.Name)
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().Pods(namespace).Update(ctx, pod, metav1.UpdateOptions{})
+}
+
+func (c *RealKubernetesClient) ListPods(ctx context.Context, namespace string, listOptions metav1.ListOptions) (_ *v1.PodList, err error) {
+	ctx, span := startClientSpan(ctx, "ListPods", namespace, "")
+	defer finishSpan(span, &err)
+
 	return client.CoreV1().Pods(namespace).List(ctx, listOptions)
 }
 
-func (c *RealKubernetesClient) DeletePod(ctx context.Context, namespace, podName string) error {
-	return client.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+// DeletePod deletes in the foreground so the pod sticks around until everything it owns is gone
+func (c *RealKubernetesClient) DeletePod(ctx context.Context, namespace, podName string) (err error) {
+	ctx, span := startClientSpan(ctx, "DeletePod", namespace, podName)
+	defer finishSpan(span, &err)
+
+	propagation := metav1.DeletePropagationForeground
+	return client.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{PropagationPolicy: &propagation})
 }
 
-func (c *RealKubernetesClient) GetPod(ctx context.Context, namespace, podName string) (*v1.Pod, error) {
+func (c *RealKubernetesClient) GetPod(ctx context.Context, namespace, podName string) (_ *v1.Pod, err error) {
+	ctx, span := startClientSpan(ctx, "GetPod", namespace, podName)
+	defer finishSpan(span, &err)
+
 	return client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 }
+
+func (c *RealKubernetesClient) ListResourceQuotas(ctx context.Context, namespace string) (_ *v1.ResourceQuotaList, err error) {
+	ctx, span := startClientSpan(ctx, "ListResourceQuotas", namespace, "")
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().ResourceQuotas(namespace).List(ctx, metav1.ListOptions{})
+}
+
+func (c *RealKubernetesClient) ListDependents(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) (_ []metav1.ObjectMeta, err error) {
+	ctx, span := startClientSpan(ctx, "ListDependents", namespace, "")
+	defer finishSpan(span, &err)
+
+	var objects []metav1.ObjectMeta
+	switch kind {
+	case "Service":
+		list, err := client.CoreV1().Services(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case "Secret":
+		list, err := client.CoreV1().Secrets(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case "ConfigMap":
+		list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case "NetworkPolicy":
+		list, err := client.NetworkingV1().NetworkPolicies(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	return objects, nil
+}
+
+func (c *RealKubernetesClient) DeleteDependent(ctx context.Context, namespace, kind, name string) (err error) {
+	ctx, span := startClientSpan(ctx, "DeleteDependent", namespace, name)
+	defer finishSpan(span, &err)
+
+	switch kind {
+	case "Service":
+		return client.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	case "Secret":
+		return client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	case "ConfigMap":
+		return client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	case "NetworkPolicy":
+		return client.NetworkingV1().NetworkPolicies(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	default:
+		return fmt.Errorf("unsupported kind %q", kind)
+	}
+}
+
+func (c *RealKubernetesClient) CreateService(ctx context.Context, namespace string, service *v1.Service) (_ *v1.Service, err error) {
+	ctx, span := startClientSpan(ctx, "CreateService", namespace, service.Name)
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+}
+
+func (c *RealKubernetesClient) CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) (_ *v1.Secret, err error) {
+	ctx, span := startClientSpan(ctx, "CreateSecret", namespace, secret.Name)
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+}
+
+func (c *RealKubernetesClient) CreateNetworkPolicy(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (_ *networkingv1.NetworkPolicy, err error) {
+	ctx, span := startClientSpan(ctx, "CreateNetworkPolicy", namespace, policy.Name)
+	defer finishSpan(span, &err)
+
+	return client.NetworkingV1().NetworkPolicies(namespace).Create(ctx, policy, metav1.CreateOptions{})
+}
+
+func (c *RealKubernetesClient) GetSecret(ctx context.Context, namespace, name string) (_ *v1.Secret, err error) {
+	ctx, span := startClientSpan(ctx, "GetSecret", namespace, name)
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *RealKubernetesClient) UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) (_ *v1.Secret, err error) {
+	ctx, span := startClientSpan(ctx, "UpdateSecret", namespace, secret.Name)
+	defer finishSpan(span, &err)
+
+	return client.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+}
+
+func (c *RealKubernetesClient) ListInstances(ctx context.Context, namespace string) (_ []TrashInstance, err error) {
+	ctx, span := startClientSpan(ctx, "ListInstances", namespace, "")
+	defer finishSpan(span, &err)
+
+	list, err := dynamicClient.Resource(TrashInstanceGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]TrashInstance, 0, len(list.Items))
+	for i := range list.Items {
+		instance, err := instanceFromUnstructured(&list.Items[i])
+		if err != nil {
+			log.Warn().Err(err).Msg("Skipping TrashInstance")
+			continue
+		}
+		instances = append(instances, *instance)
+	}
+	return instances, nil
+}
+
+func (c *RealKubernetesClient) GetInstance(ctx context.Context, namespace, name string) (_ *TrashInstance, err error) {
+	ctx, span := startClientSpan(ctx, "GetInstance", namespace, name)
+	defer finishSpan(span, &err)
+
+	u, err := dynamicClient.Resource(TrashInstanceGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return instanceFromUnstructured(u)
+}
+
+func (c *RealKubernetesClient) CreateInstance(ctx context.Context, namespace string, instance *TrashInstance) (_ *TrashInstance, err error) {
+	ctx, span := startClientSpan(ctx, "CreateInstance", namespace, instance.Name)
+	defer finishSpan(span, &err)
+
+	u, err := instanceToUnstructured(instance)
+	if err != nil {
+		return nil, err
+	}
+	created, err := dynamicClient.Resource(TrashInstanceGVR).Namespace(namespace).Create(ctx, u, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return instanceFromUnstructured(created)
+}
+
+func (c *RealKubernetesClient) UpdateInstanceStatus(ctx context.Context, namespace string, instance *TrashInstance) (_ *TrashInstance, err error) {
+	ctx, span := startClientSpan(ctx, "UpdateInstanceStatus", namespace, instance.Name)
+	defer finishSpan(span, &err)
+
+	u, err := instanceToUnstructured(instance)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := dynamicClient.Resource(TrashInstanceGVR).Namespace(namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return instanceFromUnstructured(updated)
+}
+
+// DeleteInstance deletes in the foreground, like DeletePod, so owned objects go first
+func (c *RealKubernetesClient) DeleteInstance(ctx context.Context, namespace, name string) (err error) {
+	ctx, span := startClientSpan(ctx, "DeleteInstance", namespace, name)
+	defer finishSpan(span, &err)
+
+	propagation := metav1.DeletePropagationForeground
+	return dynamicClient.Resource(TrashInstanceGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+}
@@ -0,0 +1,393 @@
+package trashdb
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds everything that can be tuned from the config file
+type Config struct {
+	DefaultTier string          `json:"defaultTier"`
+	Tiers       map[string]Tier `json:"tiers"`
+	Capacity    CapacityConfig  `json:"capacity"`
+	Pool        []PoolConfig    `json:"pool"`
+	// FailureGracePeriod is how long a broken pod is kept around before it is cleaned up, zero keeps it until it expires
+	FailureGracePeriod metav1.Duration     `json:"failureGracePeriod"`
+	ExpirationPolicy   ExpirationPolicy    `json:"expirationPolicy"`
+	Reaper             ReaperConfig        `json:"reaper"`
+	Controller         ControllerConfig    `json:"controller"`
+	Tracing            TracingConfig       `json:"tracing"`
+	Audit              AuditConfig         `json:"audit"`
+	Auth               AuthConfig          `json:"auth"`
+	RateLimit          RateLimitConfig     `json:"rateLimit"`
+	ProofOfWork        ProofOfWorkConfig   `json:"proofOfWork"`
+	CORS               CORSConfig          `json:"cors"`
+	NetworkPolicy      NetworkPolicyConfig `json:"networkPolicy"`
+	// RuntimeClassName sandboxes instance pods, e.g. with gVisor. Empty uses the cluster default.
+	RuntimeClassName string    `json:"runtimeClassName"`
+	TLS              TLSConfig `json:"tls"`
+}
+
+// TLSConfig makes instances serve TLS only, with certificates from a CA that TrashDB keeps in
+// the CASecret Secret, see tls.go
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled"`
+	CASecret string `json:"caSecret"`
+}
+
+// NetworkPolicyConfig gives every instance pod a NetworkPolicy, see networkpolicy.go
+type NetworkPolicyConfig struct {
+	Enabled bool `json:"enabled"`
+	// GatewaySelector picks the pods that connect to instances: TrashDB itself and any proxy in
+	// front of Redis. They are looked for in GatewayNamespace, or the instances' namespace if empty.
+	GatewaySelector  map[string]string `json:"gatewaySelector"`
+	GatewayNamespace string            `json:"gatewayNamespace"`
+	// AllowedNamespaces can reach instances directly
+	AllowedNamespaces []string `json:"allowedNamespaces"`
+	// DNSNamespace is where the cluster DNS runs, the only thing instances can connect to
+	DNSNamespace string `json:"dnsNamespace"`
+}
+
+// CORSConfig lists the browser origins other than TrashDB's own that may call the API and open
+// websockets, see cors.go. An entry is an origin like https://app.example.com, https://*.example.com
+// for its subdomains, or "*" for any origin.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+// ProofOfWorkConfig makes anonymous creates solve a challenge first, see pow.go. Difficulty is in
+// bits, every extra bit doubles the work. It rises towards MaxDifficulty as instances run out.
+type ProofOfWorkConfig struct {
+	Enabled       bool            `json:"enabled"`
+	Difficulty    int             `json:"difficulty"`
+	MaxDifficulty int             `json:"maxDifficulty"`
+	TTL           metav1.Duration `json:"ttl"`
+}
+
+// RateLimitConfig limits how fast clients can call the API, see ratelimit.go
+type RateLimitConfig struct {
+	// TrustedProxies are the addresses or CIDRs of proxies whose X-Forwarded-For is believed
+	TrustedProxies []string `json:"trustedProxies"`
+	// Routes maps a route like /create_pod to its limits, routes that aren't listed aren't limited
+	Routes map[string]RouteRateLimit `json:"routes"`
+}
+
+type RouteRateLimit struct {
+	PerIP  RateLimit `json:"perIP"`
+	PerKey RateLimit `json:"perKey"`
+}
+
+// RateLimit is a token bucket: PerMinute requests a minute on average and up to Burst at once.
+// A zero rate is unlimited.
+type RateLimit struct {
+	PerMinute float64 `json:"perMinute"`
+	Burst     int     `json:"burst"`
+}
+
+// AuthConfig turns on API keys, see auth.go. The keys come from KeysFile or, if that is empty,
+// the KeysSecret Secret in the namespace.
+type AuthConfig struct {
+	Enabled    bool            `json:"enabled"`
+	KeysFile   string          `json:"keysFile"`
+	KeysSecret string          `json:"keysSecret"`
+	Anonymous  AnonymousConfig `json:"anonymous"`
+	JWT        JWTConfig       `json:"jwt"`
+}
+
+// JWTConfig checks bearer tokens against local keys, see jwt.go
+type JWTConfig struct {
+	JWKSFile       string   `json:"jwksFile"`
+	PublicKeyFiles []string `json:"publicKeyFiles"`
+	Issuer         string   `json:"issuer"`
+	Audience       string   `json:"audience"`
+	// TenantClaim and SubjectClaim are the claims holding the caller's tenant and identity
+	TenantClaim  string `json:"tenantClaim"`
+	SubjectClaim string `json:"subjectClaim"`
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway metav1.Duration `json:"leeway"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.JWKSFile != "" || len(c.PublicKeyFiles) > 0
+}
+
+// AnonymousConfig decides whether calls without a key are allowed once auth is on, and their limits.
+// Zero limits fall back to the normal ones.
+type AnonymousConfig struct {
+	Enabled      bool            `json:"enabled"`
+	MaxPerClient int             `json:"maxPerClient"`
+	MaxDuration  metav1.Duration `json:"maxDuration"`
+	Tiers        []string        `json:"tiers"`
+}
+
+// AuditConfig turns on the audit log of creates, extends and deletes, an empty path keeps it off
+type AuditConfig struct {
+	Path string `json:"path"`
+}
+
+// TracingConfig sets up where spans go, see tracing.go
+type TracingConfig struct {
+	// Exporter is "otlp", "stdout" or empty to turn tracing off
+	Exporter string `json:"exporter"`
+	// Endpoint is the base URL of an OTLP/HTTP receiver, e.g. http://otel-collector:4318
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"serviceName"`
+	// SampleRatio is the share of new traces that get recorded, traces the caller sampled always are
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+// ControllerConfig turns on controller mode, where instances are TrashInstance objects and the
+// HTTP API creates those instead of pods
+type ControllerConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ReaperConfig tunes the loop that deletes expired and failed pods
+type ReaperConfig struct {
+	// DryRun only logs and reports what would be deleted
+	DryRun bool `json:"dryRun"`
+}
+
+// ExpirationPolicy decides what happens to managed pods with a missing or malformed expiration
+type ExpirationPolicy struct {
+	Action   string          `json:"action"`
+	AdoptTTL metav1.Duration `json:"adoptTTL"`
+}
+
+// PoolConfig is how many idle pods to keep ready for an engine and tier
+type PoolConfig struct {
+	Engine string `json:"engine"`
+	Tier   string `json:"tier"`
+	Size   int    `json:"size"`
+}
+
+// CapacityConfig limits how many instances can exist at once. Zero means unlimited.
+type CapacityConfig struct {
+	MaxInstances int `json:"maxInstances"`
+	MaxPerClient int `json:"maxPerClient"`
+	MaxQueued    int `json:"maxQueued"`
+}
+
+var config = DefaultConfig()
+
+func SetConfig(c *Config) {
+	config = c
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DefaultTier: "medium",
+		Tiers: map[string]Tier{
+			"small": {
+				Requests:    resourceList("100m", "64Mi"),
+				Limits:      resourceList("250m", "128Mi"),
+				MaxMemory:   "100mb",
+				MaxDuration: metav1.Duration{Duration: 30 * time.Minute},
+			},
+			"medium": {
+				Requests:    resourceList("500m", "256Mi"),
+				Limits:      resourceList("1", "512Mi"),
+				MaxMemory:   "400mb",
+				MaxDuration: metav1.Duration{Duration: 60 * time.Minute},
+			},
+			"large": {
+				Requests:    resourceList("1", "1Gi"),
+				Limits:      resourceList("2", "2Gi"),
+				MaxMemory:   "1600mb",
+				MaxDuration: metav1.Duration{Duration: 60 * time.Minute},
+			},
+		},
+		Capacity: CapacityConfig{
+			MaxInstances: 50,
+			MaxPerClient: 5,
+			MaxQueued:    100,
+		},
+		FailureGracePeriod: metav1.Duration{Duration: 5 * time.Minute},
+		ExpirationPolicy: ExpirationPolicy{
+			Action:   PolicyQuarantine,
+			AdoptTTL: metav1.Duration{Duration: 10 * time.Minute},
+		},
+		Tracing: TracingConfig{
+			ServiceName: "trashdb",
+			SampleRatio: 1,
+		},
+		Auth: AuthConfig{
+			Anonymous: AnonymousConfig{
+				MaxPerClient: 1,
+				MaxDuration:  metav1.Duration{Duration: 30 * time.Minute},
+			},
+			JWT: JWTConfig{
+				TenantClaim:  "tenant",
+				SubjectClaim: "sub",
+				Leeway:       metav1.Duration{Duration: time.Minute},
+			},
+		},
+		ProofOfWork: ProofOfWorkConfig{
+			Difficulty:    16,
+			MaxDifficulty: 22,
+			TTL:           metav1.Duration{Duration: 2 * time.Minute},
+		},
+		TLS: TLSConfig{
+			CASecret: "trashdb-ca",
+		},
+		NetworkPolicy: NetworkPolicyConfig{
+			GatewaySelector: map[string]string{"app.kubernetes.io/name": "trashdb"},
+			DNSNamespace:    "kube-system",
+		},
+		RateLimit: RateLimitConfig{
+			Routes: map[string]RouteRateLimit{
+				"/create_pod": {
+					PerIP:  RateLimit{PerMinute: 10, Burst: 5},
+					PerKey: RateLimit{PerMinute: 30, Burst: 10},
+				},
+				"/delete_pod": {
+					PerIP:  RateLimit{PerMinute: 30, Burst: 10},
+					PerKey: RateLimit{PerMinute: 60, Burst: 20},
+				},
+				"/rotate_secret": {
+					PerIP:  RateLimit{PerMinute: 10, Burst: 5},
+					PerKey: RateLimit{PerMinute: 30, Burst: 10},
+				},
+			},
+		},
+	}
+}
+
+// LoadConfig reads a YAML config file on top of the defaults. An empty path returns the defaults.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path == "" {
+		return c, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	// tiers in the file replace the default tiers instead of merging with them
+	c.Tiers = nil
+	if err := yaml.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if c.Tiers == nil {
+		c.Tiers = DefaultConfig().Tiers
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("Loaded config from %s with %d tiers", path, len(c.Tiers))
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	if _, ok := c.Tiers[c.DefaultTier]; !ok {
+		return fmt.Errorf("default tier %q is not defined", c.DefaultTier)
+	}
+	if c.Capacity.MaxInstances < 0 || c.Capacity.MaxPerClient < 0 || c.Capacity.MaxQueued < 0 {
+		return fmt.Errorf("capacity limits can't be negative")
+	}
+	switch c.ExpirationPolicy.Action {
+	case PolicyDelete, PolicyQuarantine:
+	case PolicyAdopt:
+		if c.ExpirationPolicy.AdoptTTL.Duration <= 0 {
+			return fmt.Errorf("expirationPolicy: adoptTTL must be positive")
+		}
+	default:
+		return fmt.Errorf("expirationPolicy: unknown action %q", c.ExpirationPolicy.Action)
+	}
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			return fmt.Errorf("tracing: the otlp exporter needs an endpoint")
+		}
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sampleRatio must be between 0 and 1")
+	}
+	for i := range c.Pool {
+		p := &c.Pool[i]
+		if p.Engine == "" {
+			p.Engine = DefaultEngine
+		}
+		if p.Engine != DefaultEngine {
+			return fmt.Errorf("pool: unknown engine %q", p.Engine)
+		}
+		if _, ok := c.Tiers[p.Tier]; !ok {
+			return fmt.Errorf("pool: unknown tier %q", p.Tier)
+		}
+		if p.Size < 0 {
+			return fmt.Errorf("pool: size can't be negative")
+		}
+	}
+	if c.Auth.Enabled && c.Auth.KeysFile == "" && c.Auth.KeysSecret == "" && !c.Auth.JWT.enabled() {
+		return fmt.Errorf("auth: keysFile, keysSecret or jwt keys are needed")
+	}
+	if c.Auth.JWT.enabled() && (c.Auth.JWT.Issuer == "" || c.Auth.JWT.Audience == "" || c.Auth.JWT.TenantClaim == "") {
+		return fmt.Errorf("auth: jwt needs an issuer, audience and tenantClaim")
+	}
+	if c.Auth.Anonymous.MaxPerClient < 0 || c.Auth.Anonymous.MaxDuration.Duration < 0 {
+		return fmt.Errorf("auth: anonymous limits can't be negative")
+	}
+	for _, tier := range c.Auth.Anonymous.Tiers {
+		if _, ok := c.Tiers[tier]; !ok {
+			return fmt.Errorf("auth: anonymous tier %q is not defined", tier)
+		}
+	}
+	if pow := c.ProofOfWork; pow.Enabled {
+		if pow.Difficulty < 1 || pow.MaxDifficulty > 32 || pow.MaxDifficulty < pow.Difficulty {
+			return fmt.Errorf("proofOfWork: difficulty must be at least 1 and no more than maxDifficulty, which can be at most 32")
+		}
+		if pow.TTL.Duration <= 0 {
+			return fmt.Errorf("proofOfWork: ttl must be positive")
+		}
+	}
+	for _, proxy := range c.RateLimit.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			return fmt.Errorf("rateLimit: trustedProxies: %w", err)
+		}
+	}
+	for route, limits := range c.RateLimit.Routes {
+		for _, limit := range []RateLimit{limits.PerIP, limits.PerKey} {
+			if limit.PerMinute < 0 || (limit.PerMinute > 0 && limit.Burst < 1) {
+				return fmt.Errorf("rateLimit: %s needs a positive burst for each rate", route)
+			}
+		}
+	}
+	if np := c.NetworkPolicy; np.Enabled && (len(np.GatewaySelector) == 0 || np.DNSNamespace == "") {
+		return fmt.Errorf("networkPolicy: a gatewaySelector and dnsNamespace are needed")
+	}
+	if c.TLS.Enabled {
+		if c.TLS.CASecret == "" {
+			return fmt.Errorf("tls: caSecret is needed")
+		}
+		// pool pods are started before anyone picks their name, so there is nothing to put on a certificate
+		for _, p := range c.Pool {
+			if p.Size > 0 {
+				return fmt.Errorf("tls: the pool can't be used with tls, set its sizes to 0")
+			}
+		}
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			return fmt.Errorf("cors: allowedOrigins: %w", err)
+		}
+	}
+	for name, tier := range c.Tiers {
+		if tier.MaxDuration.Duration < MinDuration {
+			return fmt.Errorf("tier %q: maxDuration must be at least %s", name, MinDuration)
+		}
+		if err := tier.Commands.validate(); err != nil {
+			return fmt.Errorf("tier %q: commands: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package trashdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The controller turns TrashInstance objects into a pod, a service and a credentials secret, keeps
+// their status up to date and deletes them once they expire. It polls like the rest of the event
+// loop. Instances are handled oldest first, so ones waiting on capacity get it in order.
+
+func credentialsSecretName(instance string) string {
+	return instance + "-credentials"
+}
+
+// ReconcileInstances runs one controller pass over every TrashInstance in the namespace
+func ReconcileInstances(ctx context.Context, client KubernetesClient, namespace string) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	instances, err := client.ListInstances(ctx, namespace)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list TrashInstances")
+		return
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].CreationTimestamp.Before(&instances[j].CreationTimestamp)
+	})
+	for i := range instances {
+		if instances[i].DeletionTimestamp != nil {
+			continue
+		}
+		if err := reconcileInstance(ctx, client, namespace, &instances[i]); err != nil {
+			log.Error().Err(err).Str("podName", instances[i].Name).Msg("Failed to reconcile TrashInstance")
+		}
+	}
+}
+
+func ReconcileTrashInstances(ctx context.Context, namespace string) {
+	ReconcileInstances(ctx, nil, namespace)
+}
+
+func reconcileInstance(ctx context.Context, client KubernetesClient, namespace string, instance *TrashInstance) error {
+	// conditions are updated in place, so they need copying for the change check at the end
+	status := instance.Status
+	status.Conditions = append([]metav1.Condition(nil), status.Conditions...)
+	owner := instanceOwnerReference(instance)
+
+	if status.ExpiresAt != nil && time.Now().After(status.ExpiresAt.Time) {
+		log.Info().Str("podName", instance.Name).Msg("TrashInstance expired")
+		reaped.record(instance.Name, "expired")
+		err := client.DeleteInstance(ctx, namespace, instance.Name)
+		deletesTotal.WithLabelValues("expired", result(err)).Inc()
+		auditSystem(ctx, ActorReaper, AuditDelete, instance.Name, result(err), err, map[string]any{"reason": "expired"})
+		return err
+	}
+
+	secret, err := ensureCredentials(ctx, client, namespace, instance, owner)
+	if err != nil {
+		return err
+	}
+	status.SecretName = credentialsSecretName(instance.Name)
+
+	pod, err := findPod(ctx, client, namespace, instance.Name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if pod == nil {
+		pod, err = createInstancePod(ctx, client, namespace, instance, secret, &status, owner)
+		if pod == nil {
+			return updateInstanceStatus(ctx, client, namespace, instance, status, err)
+		}
+	}
+
+	if status.Endpoint == "" {
+		if err := ensureService(ctx, client, namespace, instance, owner); err != nil {
+			return err
+		}
+		status.Endpoint = net.JoinHostPort(instanceHost(namespace, instance.Name), strconv.Itoa(redisPort))
+	}
+
+	status.PodName = pod.Name
+	if expiration, err := PodExpiration(*pod); err == nil {
+		status.ExpiresAt = &metav1.Time{Time: *expiration}
+	}
+
+	condition := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "Starting", Message: "Pod is not ready yet"}
+	switch reason, _, failed := PodFailure(*pod); {
+	case failed:
+		status.Phase = InstanceFailed
+		condition.Reason = reason
+		condition.Message = GetPodStatus(*pod).LastFailure
+	case isPodReady(*pod):
+		status.Phase = InstanceRunning
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "PodReady"
+		condition.Message = "Pod is ready"
+	default:
+		status.Phase = InstancePending
+	}
+	condition.ObservedGeneration = instance.Generation
+	meta.SetStatusCondition(&status.Conditions, condition)
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               "Admitted",
+		Status:             metav1.ConditionTrue,
+		Reason:             "PodCreated",
+		ObservedGeneration: instance.Generation,
+	})
+
+	return updateInstanceStatus(ctx, client, namespace, instance, status, nil)
+}
+
+// createInstancePod goes through the same capacity checks and pool as the HTTP API. A pod that
+// went missing is recreated for whatever is left of the instance's lifetime.
+func createInstancePod(ctx context.Context, client KubernetesClient, namespace string, instance *TrashInstance, secret string, status *TrashInstanceStatus, owner metav1.OwnerReference) (*v1.Pod, error) {
+	duration := instance.Spec.Duration.Duration
+	if status.ExpiresAt != nil {
+		duration = time.Until(status.ExpiresAt.Time).Truncate(time.Minute)
+		if duration < MinDuration {
+			return nil, fmt.Errorf("pod is gone and only %s of its lifetime is left", duration)
+		}
+	}
+	if engine := instance.Spec.Engine; engine != "" && engine != DefaultEngine {
+		return nil, fmt.Errorf("unknown engine %q", engine)
+	}
+
+	clientID := instance.Annotations["app.trashdb/client"]
+	if clientID == "" {
+		clientID = "controller"
+	}
+
+	pod, _, err := AdmitPod(ctx, client, namespace, CreateRequest{
+		ClientID:  clientID,
+		Tenant:    instance.Labels[tenantLabel],
+		Subject:   instance.Annotations[subjectAnnotation],
+		PodName:   instance.Name,
+		PodSecret: secret,
+		Tier:      instance.Spec.Tier,
+		Duration:  duration,
+		Labels:    instance.Spec.Labels,
+		Owner:     &owner,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("podName", instance.Name).Msg("Created pod for TrashInstance")
+	return pod, nil
+}
+
+func updateInstanceStatus(ctx context.Context, client KubernetesClient, namespace string, instance *TrashInstance, status TrashInstanceStatus, createErr error) error {
+	if createErr != nil {
+		reason := "CreateFailed"
+		var capacityErr *CapacityError
+		if errors.As(createErr, &capacityErr) {
+			reason = "CapacityExceeded"
+			status.Phase = InstancePending
+		} else {
+			status.Phase = InstanceFailed
+		}
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               "Admitted",
+			Status:             metav1.ConditionFalse,
+			Reason:             reason,
+			Message:            createErr.Error(),
+			ObservedGeneration: instance.Generation,
+		})
+	}
+
+	if equality.Semantic.DeepEqual(instance.Status, status) {
+		return nil
+	}
+	instance.Status = status
+	_, err := client.UpdateInstanceStatus(ctx, namespace, instance)
+	return err
+}
+
+// ensureCredentials returns the instance secret, generating one for instances created with kubectl
+func ensureCredentials(ctx context.Context, client KubernetesClient, namespace string, instance *TrashInstance, owner metav1.OwnerReference) (string, error) {
+	existing, err := client.GetSecret(ctx, namespace, credentialsSecretName(instance.Name))
+	if err == nil {
+		return string(existing.Data["password"]), nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	secret := generatePassword(30)
+	_, err = client.CreateSecret(ctx, namespace, credentialsSecret(namespace, instance.Name, secret, owner))
+	return secret, err
+}
+
+func credentialsSecret(namespace, instance, secret string, owner metav1.OwnerReference) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: dependentMeta(namespace, credentialsSecretName(instance), instance, owner),
+		Type:       v1.SecretTypeOpaque,
+		Data:       map[string][]byte{"password": []byte(secret)},
+	}
+}
+
+func ensureService(ctx context.Context, client KubernetesClient, namespace string, instance *TrashInstance, owner metav1.OwnerReference) error {
+	if _, err := client.CreateService(ctx, namespace, instanceService(namespace, instance.Name, owner)); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+func instanceService(namespace, instance string, owner metav1.OwnerReference) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: dependentMeta(namespace, instance, instance, owner),
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{
+				"app.kubernetes.io/managed-by": "trashdb",
+				"app.trashdb/name":             instance,
+			},
+			Ports: []v1.ServicePort{{
+				Name:       "redis",
+				Port:       redisPort,
+				TargetPort: intstr.FromInt32(redisPort),
+			}},
+		},
+	}
+}
+
+// CreateInstance is the controller mode version of a create: it stores the request as a
+// TrashInstance along with its credentials and leaves the rest to the controller
+func CreateInstance(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest) (*TrashInstance, error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	instance, err := createInstance(ctx, client, namespace, req)
+	audit(ctx, AuditCreate, req.PodName, result(err), err, map[string]any{
+		"tier":     req.Tier,
+		"duration": req.Duration.String(),
+	})
+	return instance, err
+}
+
+func createInstance(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest) (*TrashInstance, error) {
+	tierName, _, err := ValidateCreate(namespace, req.PodName, req.PodSecret, req.Tier, req.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	annotations := map[string]string{"app.trashdb/client": req.ClientID}
+	if req.Tenant != "" {
+		labels = map[string]string{tenantLabel: req.Tenant}
+	}
+	if req.Subject != "" {
+		annotations[subjectAnnotation] = req.Subject
+	}
+
+	instance, err := client.CreateInstance(ctx, namespace, &TrashInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        req.PodName,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: TrashInstanceSpec{
+			Engine:   DefaultEngine,
+			Tier:     tierName,
+			Duration: metav1.Duration{Duration: req.Duration},
+			Labels:   req.Labels,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := client.CreateSecret(ctx, namespace, credentialsSecret(namespace, instance.Name, req.PodSecret, instanceOwnerReference(instance))); err != nil {
+		client.DeleteInstance(ctx, namespace, instance.Name)
+		return nil, err
+	}
+
+	logger(ctx).Info().Msg("Created TrashInstance")
+	return instance, nil
+}
+
+// deleteInstanceOrPod deletes the root object of an instance, so a controller doesn't bring the pod back
+func deleteInstanceOrPod(ctx context.Context, client KubernetesClient, namespace string, pod v1.Pod) error {
+	if name, ok := instanceOwner(pod.ObjectMeta); ok {
+		return client.DeleteInstance(ctx, namespace, name)
+	}
+	return DeletePod(ctx, client, namespace, pod.Name)
+}
+
+// deleteInstanceWithSecret handles deletes for instances the controller hasn't made a pod for yet
+func deleteInstanceWithSecret(ctx context.Context, client KubernetesClient, namespace, name, podSecret string) error {
+	instance, err := client.GetInstance(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	if !canAccess(ctx, instance.ObjectMeta) {
+		return apierrors.NewNotFound(TrashInstanceGVR.GroupResource(), name)
+	}
+	secret, err := client.GetSecret(ctx, namespace, credentialsSecretName(instance.Name))
+	if err != nil {
+		return err
+	}
+	if string(secret.Data["password"]) != podSecret {
+		return fmt.Errorf("Wrong secret")
+	}
+	return client.DeleteInstance(ctx, namespace, instance.Name)
+}
@@ -0,0 +1,108 @@
+package trashdb_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func withController(t *testing.T, capacity trashdb.CapacityConfig) {
+	config := trashdb.DefaultConfig()
+	config.Controller.Enabled = true
+	config.Capacity = capacity
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+}
+
+func TestReconcileInstances(t *testing.T) {
+	withController(t, trashdb.CapacityConfig{MaxInstances: 1, MaxPerClient: 1})
+
+	ctx := context.Background()
+	cluster := &fakeCluster{}
+	client := cluster.client()
+
+	_, err := trashdb.CreateInstance(ctx, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "client-a",
+		PodName:   "first-instance",
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+		Labels:    map[string]string{"team": "cache", "app.trashdb/tier": "large"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating instance: %v", err)
+	}
+	// created with kubectl, no credentials yet
+	cluster.instances = append(cluster.instances, trashdb.TrashInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "second-instance", UID: "uid-second-instance", CreationTimestamp: metav1.Now()},
+		Spec:       trashdb.TrashInstanceSpec{Duration: metav1.Duration{Duration: 20 * time.Minute}},
+	})
+
+	trashdb.ReconcileInstances(ctx, client, "namespace-123")
+
+	if len(cluster.pods) != 1 {
+		t.Fatalf("Expected 1 pod, got %d", len(cluster.pods))
+	}
+	pod := cluster.pods[0]
+	if diff := cmp.Diff("first-instance", pod.OwnerReferences[0].Name); diff != "" {
+		t.Errorf("Pod owner mismatch (-expected +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(passwordHash(exampleSecret), pod.Annotations["app.trashdb/secret-hash"]); diff != "" {
+		t.Errorf("Pod secret mismatch (-expected +got):\n%s", diff)
+	}
+	if pod.Labels["team"] != "cache" || pod.Labels["app.trashdb/tier"] != "medium" {
+		t.Errorf("Expected user labels without overriding managed ones, got %v", pod.Labels)
+	}
+
+	first, second := cluster.instances[0].Status, cluster.instances[1].Status
+	if diff := cmp.Diff([]string{trashdb.InstancePending, "first-instance", "first-instance.namespace-123.svc:6379", "first-instance-credentials"},
+		[]string{first.Phase, first.PodName, first.Endpoint, first.SecretName}); diff != "" {
+		t.Errorf("First instance status mismatch (-expected +got):\n%s", diff)
+	}
+	if first.ExpiresAt == nil {
+		t.Errorf("Expected first instance to have an expiration")
+	}
+	admitted := meta.FindStatusCondition(second.Conditions, "Admitted")
+	if second.Phase != trashdb.InstancePending || admitted == nil || admitted.Reason != "CapacityExceeded" {
+		t.Errorf("Expected second instance to wait for capacity, got %+v", second)
+	}
+	var credentials int
+	for _, secret := range cluster.secrets {
+		if strings.HasSuffix(secret.Name, "-credentials") {
+			credentials++
+		}
+	}
+	if credentials != 2 {
+		t.Errorf("Expected a generated secret for the kubectl instance, got %d credentials", credentials)
+	}
+
+	cluster.pods[0].Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	trashdb.ReconcileInstances(ctx, client, "namespace-123")
+	if phase := cluster.instances[0].Status.Phase; phase != trashdb.InstanceRunning {
+		t.Errorf("Expected first instance to be running, got %s", phase)
+	}
+
+	// deleting by name takes the instance down with its pod, which frees up capacity for the second one
+	if err := trashdb.DeletePodWithSecret(ctx, client, "namespace-123", "first-instance", exampleSecret); err != nil {
+		t.Fatalf("Unexpected error deleting instance: %v", err)
+	}
+	if len(cluster.instances) != 1 || len(cluster.pods) != 0 {
+		t.Fatalf("Expected the first instance and its pod to be gone, got %d instances and %d pods", len(cluster.instances), len(cluster.pods))
+	}
+	trashdb.ReconcileInstances(ctx, client, "namespace-123")
+	if len(cluster.pods) != 1 || cluster.pods[0].Name != "second-instance" {
+		t.Fatalf("Expected a pod for the second instance, got %v", cluster.pods)
+	}
+
+	cluster.instances[0].Status.ExpiresAt = &metav1.Time{Time: time.Now().Add(-1 * time.Minute)}
+	trashdb.ReconcileInstances(ctx, client, "namespace-123")
+	if len(cluster.instances) != 0 || len(cluster.pods) != 0 {
+		t.Errorf("Expected expired instance to be deleted, got %d instances and %d pods", len(cluster.instances), len(cluster.pods))
+	}
+}
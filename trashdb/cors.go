@@ -0,0 +1,141 @@
+package trashdb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers on other sites may only call the API or open the /list_pod websocket if their origin
+// is on the allowlist. Entries are origins like https://app.example.com, https://*.example.com
+// for any subdomain, or "*" for everyone. The dashboard is served from the API itself, so
+// same-origin calls are always fine, and so are calls from outside a browser, which send no Origin.
+// Other origins can still send simple POSTs without a preflight, so state-changing requests from
+// them are refused before they run.
+
+var corsRejectedTotal = newCounterVec("trashdb_cors_rejected_total",
+	"Cross-origin requests and websocket upgrades refused because the origin isn't allowed.", "kind")
+
+const (
+	corsAllowMethods  = "GET, POST, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Authorization, X-API-Key, X-Request-ID, traceparent"
+	corsExposeHeaders = "X-Request-ID, Retry-After"
+)
+
+// OriginAllowed reports whether a browser origin is on the allowlist
+func OriginAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, allowed := range config.CORS.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+		a, err := url.Parse(allowed)
+		if err != nil || a.Scheme != u.Scheme {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(a.Host, "*."); ok {
+			// subdomains only, the bare domain has to be listed on its own
+			if strings.HasSuffix(strings.ToLower(u.Host), "."+strings.ToLower(suffix)) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(a.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOrigin checks an allowlist entry is "*" or a bare origin
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Host == "*." ||
+		u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q is not an origin like https://app.example.com", origin)
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return fmt.Errorf("%q can only have a wildcard at the start of the host", origin)
+	}
+	return nil
+}
+
+// sameOrigin is true for requests from pages served by TrashDB itself, like the dashboard
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme == requestScheme(r) && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestScheme is how the caller reached TrashDB, trusted proxies pass it on in X-Forwarded-Proto
+func requestScheme(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); isTrustedProxy(host) && (proto == "http" || proto == "https") {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// checkOrigin decides websocket upgrades
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(r, origin) || OriginAllowed(origin) {
+		return true
+	}
+	corsRejectedTotal.WithLabelValues("websocket").Inc()
+	logger(r.Context()).Warn().Str("origin", origin).Msg("Rejected websocket from origin that isn't allowed")
+	return false
+}
+
+// withCORS answers preflight requests and adds CORS headers for allowed origins
+func withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			handler(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !OriginAllowed(origin) {
+			corsRejectedTotal.WithLabelValues("http").Inc()
+			logger(r.Context()).Warn().Str("origin", origin).Msg("Rejected request from origin that isn't allowed")
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				sendResponse(w, http.StatusForbidden, "Origin not allowed", nil)
+				return
+			}
+			// reads still run, without CORS headers the browser won't let the page see them
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(w, r)
+	}
+}
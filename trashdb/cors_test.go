@@ -0,0 +1,49 @@
+package trashdb_test
+
+import (
+	"testing"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.CORS.AllowedOrigins = []string{"https://app.example.com", "https://*.trash.dev", "http://localhost:3000"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	testCases := []struct {
+		Origin   string
+		Expected bool
+	}{
+		{Origin: "https://app.example.com", Expected: true},
+		{Origin: "https://APP.example.com", Expected: true},
+		{Origin: "http://app.example.com", Expected: false},
+		{Origin: "https://app.example.com:8443", Expected: false},
+		{Origin: "https://other.example.com", Expected: false},
+		{Origin: "https://a.trash.dev", Expected: true},
+		{Origin: "https://a.b.trash.dev", Expected: true},
+		{Origin: "https://trash.dev", Expected: false},
+		{Origin: "https://eviltrash.dev", Expected: false},
+		{Origin: "https://a.trash.dev.evil.com", Expected: false},
+		{Origin: "http://localhost:3000", Expected: true},
+		{Origin: "http://localhost:3001", Expected: false},
+		{Origin: "null", Expected: false},
+		{Origin: "", Expected: false},
+	}
+	for _, tc := range testCases {
+		if got := trashdb.OriginAllowed(tc.Origin); got != tc.Expected {
+			t.Errorf("%q: expected %v, got %v", tc.Origin, tc.Expected, got)
+		}
+	}
+
+	for _, origin := range []string{"app.example.com", "https://app.example.com/path", "ftp://example.com", "https://foo.*.example.com"} {
+		config.CORS.AllowedOrigins = []string{origin}
+		if err := config.Validate(); err == nil {
+			t.Errorf("%q: expected an invalid origin error", origin)
+		}
+	}
+}
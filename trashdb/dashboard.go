@@ -0,0 +1,66 @@
+package trashdb
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+)
+
+// The dashboard is a static page built into the binary. It talks to the same API as everyone
+// else: /list_pod for the live list, /create_pod and /delete_pod for changes and /tiers to fill
+// in the create form. Nothing is loaded from outside, so it works without internet access.
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardCSP keeps the page to its own scripts and styles
+const dashboardCSP = "default-src 'self'; connect-src 'self' ws: wss:; img-src 'self' data:; frame-ancestors 'none'"
+
+func dashboardHandler() http.HandlerFunc {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			sendResponse(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", dashboardCSP)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+// TierInfo is what clients need to know about a tier to pick one
+type TierInfo struct {
+	Name        string `json:"name"`
+	MaxDuration int    `json:"maxDuration"`
+	MaxMemory   string `json:"maxmemory,omitempty"`
+	// Commands are the commands clients of the tier can't run
+	Commands CommandRules `json:"commands"`
+}
+
+func tiersRequest(w http.ResponseWriter, r *http.Request) {
+	tiers := make([]TierInfo, 0, len(config.Tiers))
+	for name, tier := range config.Tiers {
+		tiers = append(tiers, TierInfo{
+			Name:        name,
+			MaxDuration: int(tier.MaxDuration.Minutes()),
+			MaxMemory:   tier.MaxMemory,
+			Commands:    tier.commandRules(),
+		})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Name < tiers[j].Name })
+
+	sendResponse(w, http.StatusOK, "Got tiers", map[string]any{
+		"tiers":       tiers,
+		"defaultTier": config.DefaultTier,
+		"minDuration": int(MinDuration.Minutes()),
+		"engines":     []string{DefaultEngine},
+	})
+}
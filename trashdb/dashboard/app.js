@@ -0,0 +1,372 @@
+"use strict";
+
+// Passwords of instances created from this tab, so they can be deleted without asking again.
+// They are never written to storage and are gone when the tab is closed.
+const secrets = new Map();
+
+const REDIS_PORT = 6379;
+
+let expirations = new Map();
+let credentials = null;
+let socket = null;
+
+// the API key or bearer token is kept for this tab only, when the server requires one
+function apiKey() {
+  return sessionStorage.getItem("apiKey") || "";
+}
+
+// tokens are JWTs with three parts, API keys only have two
+function isToken(key) {
+  return key.split(".").length === 3;
+}
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+async function api(path, body) {
+  const headers = { "Content-Type": "application/json" };
+  if (isToken(apiKey())) {
+    headers.Authorization = `Bearer ${apiKey()}`;
+  } else if (apiKey()) {
+    headers["X-API-Key"] = apiKey();
+  }
+  const response = await fetch(path, {
+    method: body === undefined ? "GET" : "POST",
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const payload = await response.json().catch(() => ({ message: response.statusText }));
+  if (!response.ok) {
+    const error = new Error(payload.message || response.statusText);
+    error.status = response.status;
+    throw error;
+  }
+  return payload;
+}
+
+function option(value, label) {
+  const element = document.createElement("option");
+  element.value = value;
+  element.textContent = label;
+  return element;
+}
+
+async function loadTiers() {
+  const { data } = await api("/tiers");
+  for (const engine of data.engines) {
+    $("engine").append(option(engine, engine));
+  }
+  for (const tier of data.tiers) {
+    const element = option(tier.name, `${tier.name} (up to ${tier.maxDuration} min)`);
+    element.dataset.maxDuration = tier.maxDuration;
+    element.selected = tier.name === data.defaultTier;
+    $("tier").append(element);
+  }
+  $("duration").min = data.minDuration;
+  limitDuration();
+}
+
+function limitDuration() {
+  const selected = $("tier").selectedOptions[0];
+  if (selected) {
+    $("duration").max = selected.dataset.maxDuration;
+  }
+}
+
+function formatTimeLeft(seconds) {
+  if (seconds <= 0) {
+    return "expired";
+  }
+  const minutes = Math.floor(seconds / 60);
+  const rest = String(seconds % 60).padStart(2, "0");
+  return `${minutes}:${rest}`;
+}
+
+function secondsLeft(podName) {
+  const expiration = expirations.get(podName);
+  if (!expiration) {
+    return 0;
+  }
+  return Math.max(0, Math.floor((expiration - Date.now()) / 1000));
+}
+
+function statusText(status) {
+  if (status.failure) {
+    return status.failure;
+  }
+  if (status.ready) {
+    return "ready";
+  }
+  return status.containerState || status.phase || "pending";
+}
+
+function render(data) {
+  const statuses = data.statuses || [];
+
+  expirations = new Map();
+  const tbody = $("instances");
+  tbody.replaceChildren();
+
+  for (const status of statuses) {
+    const name = status.podName;
+    if (status.expiration) {
+      expirations.set(name, Date.parse(status.expiration));
+    }
+
+    const row = document.createElement("tr");
+    const cells = [
+      name,
+      status.tier || "",
+      statusText(status),
+      status.podIP ? `${status.podIP}:${REDIS_PORT}` : "",
+      formatTimeLeft(secondsLeft(name)),
+    ];
+    for (const text of cells) {
+      const cell = document.createElement("td");
+      cell.textContent = text;
+      row.append(cell);
+    }
+    row.children[2].className = status.failure ? "failing" : status.ready ? "ready" : "";
+    row.children[4].dataset.podName = name;
+
+    const deleteCell = document.createElement("td");
+    const button = document.createElement("button");
+    button.className = "danger";
+    button.textContent = "Delete";
+    button.addEventListener("click", () => deleteInstance(name));
+    const rotate = document.createElement("button");
+    rotate.className = "secondary";
+    rotate.textContent = "New password";
+    rotate.addEventListener("click", () => rotateSecret(name));
+    deleteCell.append(rotate, button);
+    row.append(deleteCell);
+
+    tbody.append(row);
+
+    if (credentials && credentials.podName === name && status.podIP) {
+      showCommand(status.podIP);
+    }
+  }
+  $("empty").hidden = statuses.length > 0;
+
+  const queue = data.queue || [];
+  $("queue-section").hidden = queue.length === 0;
+  $("queue").replaceChildren(...queue.map((entry) => {
+    const item = document.createElement("li");
+    item.textContent = `${entry.podName} (${entry.tier || "default tier"})`;
+    if (entry.error) {
+      item.textContent += ` failed: ${entry.error}`;
+      item.className = "failing";
+    }
+    return item;
+  }));
+}
+
+// the list only arrives once a second, the countdowns tick on their own in between
+function tick() {
+  for (const cell of document.querySelectorAll("td[data-pod-name]")) {
+    const seconds = secondsLeft(cell.dataset.podName);
+    cell.textContent = formatTimeLeft(seconds);
+    cell.className = seconds < 60 ? "expiring" : "";
+  }
+}
+
+function connect() {
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+  // browsers can't set headers on websockets, the key goes along as a subprotocol instead of in
+  // the URL where it would end up in access logs
+  const protocols = ["trashdb"];
+  if (apiKey()) {
+    protocols.push(`${isToken(apiKey()) ? "trashdb.token." : "trashdb.key."}${apiKey()}`);
+  }
+  socket = new WebSocket(`${scheme}//${location.host}/list_pod`, protocols);
+
+  socket.addEventListener("open", () => {
+    $("connection").textContent = "Live";
+    $("connection").className = "badge online";
+  });
+  socket.addEventListener("message", (event) => {
+    render(JSON.parse(event.data).data || {});
+  });
+  socket.addEventListener("close", (event) => {
+    $("connection").textContent = "Reconnecting…";
+    $("connection").className = "badge offline";
+    if (event.target === socket) {
+      setTimeout(connect, 2000);
+    }
+  });
+}
+
+function useKey(event) {
+  event.preventDefault();
+  sessionStorage.setItem("apiKey", $("api-key").value.trim());
+  $("api-key").value = "";
+  const old = socket;
+  connect();
+  old.close();
+}
+
+// with TLS on, instances are reached by their Service name and verified with the CA from the create
+function showCredentials(podName, podSecret, host, caCert) {
+  credentials = { podName, podSecret, caCert };
+  $("cred-name").textContent = podName;
+  $("cred-secret").textContent = podSecret;
+  $("cred-command").textContent = "waiting for the instance to get an address…";
+  $("download-ca").hidden = !caCert;
+  $("credentials").hidden = false;
+  if (host) {
+    credentials.command = `redis-cli --tls --cacert trashdb-ca.crt -h ${host} -p ${REDIS_PORT} -a '${podSecret}'`;
+    $("cred-command").textContent = credentials.command;
+  }
+}
+
+function showCommand(podIP) {
+  if (credentials.caCert) {
+    return;
+  }
+  credentials.command = `redis-cli -h ${podIP} -p ${REDIS_PORT} -a '${credentials.podSecret}'`;
+  $("cred-command").textContent = credentials.command;
+}
+
+function downloadCA() {
+  const link = document.createElement("a");
+  link.href = URL.createObjectURL(new Blob([credentials.caCert], { type: "application/x-pem-file" }));
+  link.download = "trashdb-ca.crt";
+  link.click();
+  URL.revokeObjectURL(link.href);
+}
+
+function hideCredentials() {
+  credentials = null;
+  $("cred-secret").textContent = "";
+  $("cred-command").textContent = "";
+  $("credentials").hidden = true;
+}
+
+async function copy(text, button) {
+  if (!text) {
+    return;
+  }
+  try {
+    await navigator.clipboard.writeText(text);
+  } catch {
+    // the clipboard API needs https, fall back to the old way over plain http
+    const area = document.createElement("textarea");
+    area.value = text;
+    document.body.append(area);
+    area.select();
+    document.execCommand("copy");
+    area.remove();
+  }
+  const label = button.textContent;
+  button.textContent = "Copied";
+  setTimeout(() => { button.textContent = label; }, 1500);
+}
+
+async function createInstance(event) {
+  event.preventDefault();
+  const error = $("create-error");
+  error.hidden = true;
+
+  const request = {
+    engine: $("engine").value,
+    tier: $("tier").value,
+    duration: Number($("duration").value),
+    podName: $("pod-name").value.trim(),
+    queue: true,
+  };
+
+  try {
+    let data;
+    try {
+      ({ data } = await api("/create_pod", request));
+    } catch (err) {
+      // anonymous creates may need a proof of work first
+      if (err.status !== 428) {
+        throw err;
+      }
+      ({ data } = await api("/create_pod", { ...request, ...(await proofOfWork()) }));
+    }
+    secrets.set(data.podName, data.podSecret);
+    showCredentials(data.podName, data.podSecret, data.host, data.caCert);
+    $("pod-name").value = "";
+  } catch (err) {
+    error.textContent = err.message;
+    error.hidden = false;
+  }
+}
+
+async function proofOfWork() {
+  const { data } = await api("/challenge");
+  if (!data.required) {
+    return {};
+  }
+  const button = $("create-form").querySelector("button");
+  button.disabled = true;
+  button.textContent = "Working…";
+  try {
+    return { challenge: data.challenge, solution: await solveChallenge(data.challenge, data.difficulty) };
+  } finally {
+    button.disabled = false;
+    button.textContent = "Create";
+  }
+}
+
+async function deleteInstance(podName) {
+  let podSecret = secrets.get(podName);
+  if (!podSecret) {
+    podSecret = prompt(`Password for ${podName}:`);
+    if (!podSecret) {
+      return;
+    }
+  } else if (!confirm(`Delete ${podName}?`)) {
+    return;
+  }
+
+  try {
+    await api("/delete_pod", { podName, podSecret });
+    secrets.delete(podName);
+    if (credentials && credentials.podName === podName) {
+      hideCredentials();
+    }
+  } catch (err) {
+    alert(`Failed to delete ${podName}: ${err.message}`);
+  }
+}
+
+// the old password stops working right away, clients using it are disconnected
+async function rotateSecret(podName) {
+  let podSecret = secrets.get(podName);
+  if (!podSecret) {
+    podSecret = prompt(`Current password for ${podName}:`);
+    if (!podSecret) {
+      return;
+    }
+  } else if (!confirm(`Replace the password of ${podName}? Connected clients will be logged out.`)) {
+    return;
+  }
+
+  try {
+    const { data } = await api("/rotate_secret", { podName, podSecret });
+    secrets.set(podName, data.podSecret);
+    showCredentials(podName, data.podSecret, data.host, data.caCert);
+  } catch (err) {
+    alert(`Failed to change the password of ${podName}: ${err.message}`);
+  }
+}
+
+$("tier").addEventListener("change", limitDuration);
+$("create-form").addEventListener("submit", createInstance);
+$("copy-secret").addEventListener("click", (event) => copy(credentials && credentials.podSecret, event.target));
+$("copy-command").addEventListener("click", (event) => copy(credentials && credentials.command, event.target));
+$("download-ca").addEventListener("click", downloadCA);
+$("dismiss-credentials").addEventListener("click", hideCredentials);
+$("key-form").addEventListener("submit", useKey);
+
+loadTiers().catch((err) => {
+  $("create-error").textContent = `Failed to load tiers: ${err.message}`;
+  $("create-error").hidden = false;
+});
+connect();
+setInterval(tick, 1000);
@@ -0,0 +1,30 @@
+package trashdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// The dashboard has to work without internet access, so nothing in it may point off the server
+func TestDashboardIsSelfContained(t *testing.T) {
+	external := regexp.MustCompile(`(?i)(src|href)\s*=\s*["']?(https?:)?//|@import|url\(\s*["']?(https?:)?//`)
+
+	files, err := filepath.Glob("dashboard/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("Expected dashboard files")
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := external.Find(content); match != nil {
+			t.Errorf("%s loads something from outside: %q", file, match)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package trashdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Every object created for an instance (services, secrets, network policies...) is owned by one root
+// object, the instance's pod or its TrashInstance in controller mode, so Kubernetes
+// garbage-collects it when the root goes. Roots are deleted in the foreground, so they only
+// disappear once their dependents are gone.
+
+// DependentKinds are the kinds the orphan sweep looks at
+var DependentKinds = []string{"Service", "Secret", "ConfigMap", "NetworkPolicy"}
+
+// orphanMinAge keeps the sweep away from objects that are still being set up
+const orphanMinAge = 1 * time.Minute
+
+var orphansDeletedTotal = newCounterVec("trashdb_orphans_deleted_total",
+	"Objects with trashdb labels but no live owner deleted by the orphan sweep.", "kind", "result")
+
+func ownerReference(pod *v1.Pod) metav1.OwnerReference {
+	isTrue := true
+	return metav1.OwnerReference{
+		APIVersion:         "v1",
+		Kind:               "Pod",
+		Name:               pod.Name,
+		UID:                pod.UID,
+		Controller:         &isTrue,
+		BlockOwnerDeletion: &isTrue,
+	}
+}
+
+// rootOwner is the object everything for the instance hangs off: its TrashInstance in controller
+// mode, otherwise the pod itself
+func rootOwner(pod *v1.Pod) metav1.OwnerReference {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "TrashInstance" {
+			return owner
+		}
+	}
+	return ownerReference(pod)
+}
+
+// dependentMeta is the metadata for an object that belongs to the instance with the given name
+func dependentMeta(namespace, name, instance string, owner metav1.OwnerReference) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels: map[string]string{
+			"app.kubernetes.io/managed-by": "trashdb",
+			"app.kubernetes.io/part-of":    "trashdb",
+			"app.kubernetes.io/instance":   "redis-" + instance,
+			"app.trashdb/name":             instance,
+		},
+		OwnerReferences: []metav1.OwnerReference{owner},
+	}
+}
+
+// SweepOrphans deletes objects that carry the trashdb labels but whose owner is gone, or that
+// never had one. Garbage collection handles the normal case, this catches whatever slips through.
+func SweepOrphans(ctx context.Context, client KubernetesClient, namespace string) map[string]int {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	pods, err := client.ListPods(ctx, namespace, metav1.ListOptions{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pods for orphan sweep")
+		return nil
+	}
+	live := map[types.UID]bool{}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp == nil {
+			live[pod.UID] = true
+		}
+	}
+	if config.Controller.Enabled {
+		instances, err := client.ListInstances(ctx, namespace)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list instances for orphan sweep")
+			return nil
+		}
+		for _, instance := range instances {
+			if instance.DeletionTimestamp == nil {
+				live[instance.UID] = true
+			}
+		}
+	}
+
+	deleted := map[string]int{}
+	for _, kind := range DependentKinds {
+		objects, err := client.ListDependents(ctx, namespace, kind, metav1.ListOptions{
+			LabelSelector: managedBySelector,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("kind", kind).Msg("Failed to list objects for orphan sweep")
+			continue
+		}
+
+		for _, object := range objects {
+			if object.DeletionTimestamp != nil || time.Since(object.CreationTimestamp.Time) < orphanMinAge || hasLiveOwner(object, live) {
+				continue
+			}
+
+			err := client.DeleteDependent(ctx, namespace, kind, object.Name)
+			auditSystem(ctx, ActorOrphanSweep, AuditDelete, object.Labels["app.trashdb/name"], result(err), err, map[string]any{"kind": kind, "name": object.Name})
+			if err != nil {
+				log.Error().Err(err).Str("kind", kind).Str("name", object.Name).Msg("Failed to delete orphan")
+				orphansDeletedTotal.WithLabelValues(kind, "failure").Inc()
+				continue
+			}
+			orphansDeletedTotal.WithLabelValues(kind, "success").Inc()
+			deleted[kind]++
+		}
+	}
+
+	for kind, count := range deleted {
+		log.Info().Str("kind", kind).Msgf("Deleted %d orphans", count)
+	}
+	return deleted
+}
+
+func hasLiveOwner(object metav1.ObjectMeta, live map[types.UID]bool) bool {
+	for _, owner := range object.OwnerReferences {
+		if live[owner.UID] {
+			return true
+		}
+	}
+	return false
+}
+
+func SweepOrphanedObjects(ctx context.Context, namespace string) {
+	SweepOrphans(ctx, nil, namespace)
+}
@@ -0,0 +1,57 @@
+package trashdb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSweepOrphans(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-1 * time.Hour))
+	owned := func(name string, owner types.UID, created metav1.Time) metav1.ObjectMeta {
+		meta := metav1.ObjectMeta{Name: name, CreationTimestamp: created}
+		if owner != "" {
+			meta.OwnerReferences = []metav1.OwnerReference{{Kind: "Pod", Name: "owner", UID: owner}}
+		}
+		return meta
+	}
+
+	live := trashdb.NewPod(trashdb.WithName("live"))
+	live.UID = "live-uid"
+
+	cluster := &fakeCluster{
+		pods: []v1.Pod{*live},
+		dependents: map[string][]metav1.ObjectMeta{
+			"Service": {
+				owned("has-owner", "live-uid", old),
+				owned("owner-gone", "gone-uid", old),
+			},
+			"Secret": {
+				owned("no-owner", "", old),
+				owned("just-created", "", metav1.Now()),
+			},
+		},
+	}
+
+	deleted := trashdb.SweepOrphans(context.Background(), cluster.client(), "namespace-123")
+
+	if diff := cmp.Diff(map[string]int{"Service": 1, "Secret": 1}, deleted); diff != "" {
+		t.Errorf("Deleted counts mismatch (-expected +got):\n%s", diff)
+	}
+
+	var left []string
+	for _, kind := range trashdb.DependentKinds {
+		for _, object := range cluster.dependents[kind] {
+			left = append(left, kind+"/"+object.Name)
+		}
+	}
+	if diff := cmp.Diff([]string{"Service/has-owner", "Secret/just-created"}, left); diff != "" {
+		t.Errorf("Remaining objects mismatch (-expected +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,141 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Lifecycle events are recorded on the instance's pod so `kubectl describe pod` and
+// `kubectl get events` show who created, extended or deleted it and why it went away.
+const (
+	EventCreated       = "Created"
+	EventExtended      = "Extended"
+	EventSecretRotated = "SecretRotated"
+	EventReady         = "Ready"
+	EventFailing       = "InstanceFailing"
+	EventExpired       = "Expired"
+	EventReaped        = "Reaped"
+	EventDeleted       = "Deleted"
+)
+
+// recorder does nothing until SetEventRecorder is called, so tests and the reap command don't need one
+var recorder record.EventRecorder = &record.FakeRecorder{}
+
+func SetEventRecorder(r record.EventRecorder) {
+	recorder = r
+}
+
+// NewEventRecorder sends events to the API server in the background, call the returned function
+// to flush them before exiting
+func NewEventRecorder(clientset kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "trashdb"}), broadcaster.Shutdown
+}
+
+// RequestMeta says who is behind an API call. It ends up in events and the audit log, so it must
+// never hold a secret.
+type RequestMeta struct {
+	RequestID string
+	ClientIP  string
+	APIKeyID  string
+	Tenant    string
+	// Subject is who the caller is within the tenant, from a bearer token
+	Subject string
+	// Admin callers can see and manage every tenant's instances
+	Admin bool
+}
+
+type requestMetaKey struct{}
+
+func WithRequestMeta(ctx context.Context, meta RequestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, meta)
+}
+
+func requestMetaFrom(ctx context.Context) RequestMeta {
+	meta, _ := ctx.Value(requestMetaKey{}).(RequestMeta)
+	return meta
+}
+
+func (m RequestMeta) annotations() map[string]string {
+	annotations := map[string]string{}
+	if m.ClientIP != "" {
+		annotations["app.trashdb/client-ip"] = m.ClientIP
+	}
+	if m.APIKeyID != "" {
+		annotations["app.trashdb/api-key-id"] = m.APIKeyID
+	}
+	if m.Tenant != "" {
+		annotations[tenantLabel] = m.Tenant
+	}
+	if m.Subject != "" {
+		annotations[subjectAnnotation] = m.Subject
+	}
+	return annotations
+}
+
+func (m RequestMeta) String() string {
+	var parts []string
+	if m.ClientIP != "" {
+		parts = append(parts, "client "+m.ClientIP)
+	}
+	if m.APIKeyID != "" {
+		parts = append(parts, "API key "+m.APIKeyID)
+	}
+	if m.Tenant != "" {
+		parts = append(parts, "tenant "+m.Tenant)
+	}
+	if m.Subject != "" {
+		parts = append(parts, "subject "+m.Subject)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// recordEvent attaches an event to the pod, along with whoever made the request in ctx
+func recordEvent(ctx context.Context, pod *v1.Pod, eventType, reason, messageFmt string, args ...any) {
+	meta := requestMetaFrom(ctx)
+	message := fmt.Sprintf(messageFmt, args...)
+	if requester := meta.String(); requester != "" {
+		message += " (requested by " + requester + ")"
+	}
+	recorder.AnnotatedEventf(pod, meta.annotations(), eventType, reason, "%s", message)
+}
+
+var createToReadySeconds = newHistogramVec("trashdb_create_to_ready_seconds",
+	"Time from create (or claim from the pool) to the instance being ready, as seen by the pod cache.", startupBuckets, "tier")
+
+// recordTransitions records the events nobody asks for: an instance becoming ready or starting to fail.
+// They are picked up by comparing pod cache updates.
+func recordTransitions(old, current *v1.PodList) {
+	previous := map[string]v1.Pod{}
+	for _, pod := range old.Items {
+		previous[pod.Name] = pod
+	}
+
+	ctx := context.Background()
+	for i := range current.Items {
+		pod := &current.Items[i]
+		if isIdlePoolPod(*pod) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		before, seen := previous[pod.Name]
+
+		if isPodReady(*pod) && (!seen || isIdlePoolPod(before) || !isPodReady(before)) {
+			recordEvent(ctx, pod, v1.EventTypeNormal, EventReady, "Instance %s is ready", instanceName(*pod))
+			createToReadySeconds.WithLabelValues(pod.Labels["app.trashdb/tier"]).Observe(time.Since(podCreated(*pod)).Seconds())
+		}
+		if reason, _, failed := PodFailure(*pod); failed {
+			if _, _, wasFailed := PodFailure(before); !seen || !wasFailed {
+				recordEvent(ctx, pod, v1.EventTypeWarning, EventFailing, "Instance %s is failing: %s", instanceName(*pod), reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package trashdb_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func withRecorder(t *testing.T) *record.FakeRecorder {
+	recorder := record.NewFakeRecorder(100)
+	trashdb.SetEventRecorder(recorder)
+	t.Cleanup(func() { trashdb.SetEventRecorder(&record.FakeRecorder{}) })
+	return recorder
+}
+
+// drainEvents returns the events recorded so far as "<type> <reason> <message>"
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	recorder := withRecorder(t)
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	ctx := trashdb.WithRequestMeta(context.Background(), trashdb.RequestMeta{ClientIP: "10.0.0.1", APIKeyID: "key-1"})
+
+	if _, _, err := trashdb.AdmitPod(ctx, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "10.0.0.1",
+		PodName:   "pod-123",
+		PodSecret: exampleSecret,
+		Duration:  10 * time.Minute,
+	}, false); err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+
+	// the pod becoming ready is noticed by the cache update, not a request
+	trashdb.UpdatePodsCache(&v1.PodList{Items: cluster.pods})
+	ready := cluster.pods[0].DeepCopy()
+	ready.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	trashdb.UpdatePodsCache(&v1.PodList{Items: []v1.Pod{*ready}})
+	trashdb.UpdatePodsCache(&v1.PodList{Items: []v1.Pod{*ready}})
+
+	if _, err := trashdb.ExtendPod(ctx, client, "namespace-123", "pod-123", exampleSecret, 5*time.Minute); err != nil {
+		t.Fatalf("Unexpected error extending pod: %v", err)
+	}
+	if err := trashdb.DeletePodWithSecret(ctx, client, "namespace-123", "pod-123", exampleSecret); err != nil {
+		t.Fatalf("Unexpected error deleting pod: %v", err)
+	}
+
+	events := drainEvents(recorder)
+	var reasons []string
+	for _, event := range events {
+		reasons = append(reasons, strings.Fields(event)[1])
+		if strings.Contains(event, exampleSecret) {
+			t.Errorf("Event leaks the secret: %s", event)
+		}
+	}
+	expected := []string{trashdb.EventCreated, trashdb.EventReady, trashdb.EventExtended, trashdb.EventDeleted}
+	if diff := cmp.Diff(expected, reasons); diff != "" {
+		t.Errorf("Event reasons mismatch (-expected +got):\n%s", diff)
+	}
+	if !strings.Contains(events[0], "(requested by client 10.0.0.1, API key key-1)") {
+		t.Errorf("Expected create event to say who asked for it, got %q", events[0])
+	}
+}
@@ -0,0 +1,80 @@
+package trashdb
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// waiting reasons that mean the container isn't going to start without someone stepping in
+var failedWaitingReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// PodFailure classifies a pod that is stuck or broken. It returns the reason and roughly when the
+// pod got into that state, or ok=false for a healthy (or still starting) pod.
+func PodFailure(pod v1.Pod) (reason string, since time.Time, ok bool) {
+	since = pod.CreationTimestamp.Time
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && !condition.LastTransitionTime.IsZero() {
+			since = condition.LastTransitionTime.Time
+		}
+	}
+
+	if pod.Status.Phase == v1.PodFailed {
+		return "Failed", since, true
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse && condition.Reason == v1.PodReasonUnschedulable {
+			return v1.PodReasonUnschedulable, condition.LastTransitionTime.Time, true
+		}
+	}
+
+	for _, container := range pod.Status.ContainerStatuses {
+		if waiting := container.State.Waiting; waiting != nil && failedWaitingReasons[waiting.Reason] {
+			return waiting.Reason, since, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// reapLog remembers why recently deleted pods were removed, so status requests for them can say why
+type reapLog struct {
+	mu      sync.Mutex
+	order   []string
+	reasons map[string]string
+}
+
+const reapLogSize = 200
+
+var reaped = &reapLog{reasons: map[string]string{}}
+
+func (l *reapLog) record(podName, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.reasons[podName]; !ok {
+		l.order = append(l.order, podName)
+	}
+	l.reasons[podName] = reason
+
+	if len(l.order) > reapLogSize {
+		delete(l.reasons, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+func (l *reapLog) reason(podName string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reason, ok := l.reasons[podName]
+	return reason, ok
+}
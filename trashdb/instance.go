@@ -0,0 +1,107 @@
+package trashdb
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// TrashInstance is the custom resource for an instance, see manifest.yaml for the CRD.
+// In controller mode it is the root object: the pod, service and credentials secret are owned by it.
+type TrashInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TrashInstanceSpec   `json:"spec"`
+	Status TrashInstanceStatus `json:"status,omitempty"`
+}
+
+type TrashInstanceSpec struct {
+	Engine   string            `json:"engine,omitempty"`
+	Tier     string            `json:"tier,omitempty"`
+	Duration metav1.Duration   `json:"duration"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type TrashInstanceStatus struct {
+	Phase      string             `json:"phase,omitempty"`
+	PodName    string             `json:"podName,omitempty"`
+	Endpoint   string             `json:"endpoint,omitempty"`
+	SecretName string             `json:"secretName,omitempty"`
+	ExpiresAt  *metav1.Time       `json:"expiresAt,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	InstancePending = "Pending"
+	InstanceRunning = "Running"
+	InstanceFailed  = "Failed"
+)
+
+var TrashInstanceGVR = schema.GroupVersionResource{Group: "app.trashdb", Version: "v1alpha1", Resource: "trashinstances"}
+
+func instanceToUnstructured(instance *TrashInstance) (*unstructured.Unstructured, error) {
+	instance.APIVersion = TrashInstanceGVR.GroupVersion().String()
+	instance.Kind = "TrashInstance"
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(instance)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+func instanceFromUnstructured(u *unstructured.Unstructured) (*TrashInstance, error) {
+	var instance TrashInstance
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode TrashInstance %s: %w", u.GetName(), err)
+	}
+	return &instance, nil
+}
+
+func instanceOwnerReference(instance *TrashInstance) metav1.OwnerReference {
+	isTrue := true
+	return metav1.OwnerReference{
+		APIVersion:         TrashInstanceGVR.GroupVersion().String(),
+		Kind:               "TrashInstance",
+		Name:               instance.Name,
+		UID:                instance.UID,
+		Controller:         &isTrue,
+		BlockOwnerDeletion: &isTrue,
+	}
+}
+
+// WithOwner makes the pod part of a TrashInstance, a nil owner leaves the pod as the root object
+func WithOwner(owner *metav1.OwnerReference) PodOption {
+	return func(p *v1.Pod) {
+		if owner != nil {
+			p.OwnerReferences = append(p.OwnerReferences, *owner)
+		}
+	}
+}
+
+// instanceOwner returns the name of the TrashInstance that owns an object, if any
+func instanceOwner(meta metav1.ObjectMeta) (string, bool) {
+	for _, owner := range meta.OwnerReferences {
+		if owner.Kind == "TrashInstance" {
+			return owner.Name, true
+		}
+	}
+	return "", false
+}
+
+// userLabels drops labels that would clash with the ones TrashDB manages
+func userLabels(labels map[string]string) map[string]string {
+	filtered := map[string]string{}
+	for k, v := range labels {
+		if strings.HasPrefix(k, "app.kubernetes.io/") || strings.HasPrefix(k, "app.trashdb/") {
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
@@ -0,0 +1,334 @@
+package trashdb
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Bearer tokens are JWTs from the company IdP, checked against public keys from a JWKS file or
+// PEM files. Nothing is fetched at request time, the files are reloaded by the event loop so key
+// rotation only needs the files updated. A configured claim says which tenant the caller is in,
+// another one who they are.
+
+// jwtKey is a verification key, kid and alg are empty for PEM keys
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+var jwtKeys struct {
+	mu   sync.RWMutex
+	keys []jwtKey
+}
+
+// TokenIdentity is who a verified token says the caller is
+type TokenIdentity struct {
+	Tenant  string
+	Subject string
+}
+
+// LoadJWTKeys (re)reads the keys tokens are checked against. On failure the keys loaded before
+// stay in use.
+func LoadJWTKeys() error {
+	c := config.Auth.JWT
+	var keys []jwtKey
+	if c.JWKSFile != "" {
+		raw, err := os.ReadFile(c.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS: %w", err)
+		}
+		jwks, err := parseJWKS(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse JWKS: %w", err)
+		}
+		keys = append(keys, jwks...)
+	}
+	for _, path := range c.PublicKeyFiles {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read public key: %w", err)
+		}
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return fmt.Errorf("%s has no PEM block", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse public key %s: %w", path, err)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+
+	jwtKeys.mu.Lock()
+	changed := len(keys) != len(jwtKeys.keys)
+	jwtKeys.keys = keys
+	jwtKeys.mu.Unlock()
+	if changed {
+		log.Info().Msgf("Loaded %d token verification keys", len(keys))
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(raw []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("bad coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks sig over input with key, the algorithm has to suit the key so a token
+// can't pick a weaker check than the key was meant for
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) bool {
+	hashFor := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		hash, ok := hashFor[alg]
+		if !ok || alg[0] == 'E' {
+			return false
+		}
+		h := hash.New()
+		h.Write(input)
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig) == nil
+		}
+		return rsa.VerifyPSS(key, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case *ecdsa.PublicKey:
+		expected := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		if expected[alg] != key.Curve.Params().Name {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		h := hashFor[alg].New()
+		h.Write(input)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, input, sig)
+	default:
+		return false
+	}
+}
+
+// audience is the aud claim, which can be a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(raw []byte) error {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// VerifyJWT checks a bearer token's signature, issuer, audience and lifetime and maps its claims
+// to a tenant and subject
+func VerifyJWT(token string) (TokenIdentity, error) {
+	invalid := func(message string) (TokenIdentity, error) {
+		return TokenIdentity{}, &errUnauthorized{reason: "invalid", message: message}
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return invalid("malformed token")
+	}
+	rawPayload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return invalid("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return invalid("malformed token")
+	}
+
+	jwtKeys.mu.RLock()
+	keys := jwtKeys.keys
+	jwtKeys.mu.RUnlock()
+
+	input := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, input, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return invalid("invalid token signature")
+	}
+
+	// claims are only looked at once the signature checks out
+	var claims struct {
+		Issuer    string      `json:"iss"`
+		Audience  audience    `json:"aud"`
+		ExpiresAt json.Number `json:"exp"`
+		NotBefore json.Number `json:"nbf"`
+	}
+	var all map[string]any
+	if err := json.Unmarshal(rawPayload, &claims); err != nil {
+		return invalid("malformed token claims")
+	}
+	if err := json.Unmarshal(rawPayload, &all); err != nil {
+		return invalid("malformed token claims")
+	}
+
+	c := config.Auth.JWT
+	now := time.Now()
+	leeway := c.Leeway.Duration
+	if claims.Issuer != c.Issuer {
+		return invalid("token has the wrong issuer")
+	}
+	if !slices.Contains(claims.Audience, c.Audience) {
+		return invalid("token is for another audience")
+	}
+	exp, err := claims.ExpiresAt.Float64()
+	if err != nil {
+		return invalid("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return TokenIdentity{}, &errUnauthorized{reason: "expired", message: "token has expired"}
+	}
+	if claims.NotBefore != "" {
+		nbf, err := claims.NotBefore.Float64()
+		if err != nil || now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return invalid("token is not valid yet")
+		}
+	}
+
+	tenant, _ := all[c.TenantClaim].(string)
+	if !validAuthName.MatchString(tenant) {
+		return invalid(fmt.Sprintf("token has no usable %q claim", c.TenantClaim))
+	}
+	subject, _ := all[c.SubjectClaim].(string)
+	return TokenIdentity{Tenant: tenant, Subject: subject}, nil
+}
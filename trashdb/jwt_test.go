@@ -0,0 +1,150 @@
+package trashdb_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(input))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(sig)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := trashdb.DefaultConfig()
+	config.Auth.Enabled = true
+	config.Auth.JWT.JWKSFile = path
+	config.Auth.JWT.Issuer = "https://idp.example.com"
+	config.Auth.JWT.Audience = "trashdb"
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+	if err := trashdb.LoadJWTKeys(); err != nil {
+		t.Fatalf("Unexpected error loading keys: %v", err)
+	}
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"trashdb", "other"},
+			"sub":    "alice@example.com",
+			"tenant": "team-a",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	testCases := []struct {
+		Name        string
+		Token       string
+		ExpectError bool
+	}{
+		{Name: "RS256", Token: signJWT(t, "RS256", "rsa", rsaKey, claims(nil))},
+		{Name: "ES256", Token: signJWT(t, "ES256", "ec", ecKey, claims(nil))},
+		{Name: "EdDSA", Token: signJWT(t, "EdDSA", "ed", edKey, claims(nil))},
+		{Name: "no kid", Token: signJWT(t, "ES256", "", ecKey, claims(nil))},
+		{Name: "single audience", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"aud": "trashdb"}))},
+		{Name: "within leeway", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"exp": time.Now().Add(-30 * time.Second).Unix()}))},
+		{Name: "unknown signer", Token: signJWT(t, "ES256", "ec", otherKey, claims(nil)), ExpectError: true},
+		{Name: "alg doesn't suit the key", Token: signJWT(t, "ES384", "ec", ecKey, claims(nil)), ExpectError: true},
+		{Name: "alg none", Token: b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"tenant":"team-a"}`)) + ".", ExpectError: true},
+		{Name: "expired", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), ExpectError: true},
+		{Name: "no expiry", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"exp": nil})), ExpectError: true},
+		{Name: "not valid yet", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})), ExpectError: true},
+		{Name: "wrong issuer", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"iss": "https://evil.example.com"})), ExpectError: true},
+		{Name: "wrong audience", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"aud": "other"})), ExpectError: true},
+		{Name: "no tenant", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"tenant": nil})), ExpectError: true},
+		{Name: "tenant isn't a label", Token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]any{"tenant": "Team A"})), ExpectError: true},
+		{Name: "garbage", Token: "not.a.token", ExpectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			identity, err := trashdb.VerifyJWT(tc.Token)
+			if tc.ExpectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := trashdb.TokenIdentity{Tenant: "team-a", Subject: "alice@example.com"}
+			if identity != expected {
+				t.Errorf("Expected %+v, got %+v", expected, identity)
+			}
+		})
+	}
+}
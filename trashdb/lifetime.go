@@ -0,0 +1,165 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+var extendsTotal = newCounterVec("trashdb_extends_total",
+	"Instance extends by result: success, failure or invalid.", "result")
+
+// deadlineGrace is how long past its expiration a pod may live before Kubernetes kills it on its
+// own. The reaper normally gets there first, the deadline only matters while TrashDB is down.
+const deadlineGrace = 5 * time.Minute
+
+// The deadline is set from the longest lifetime of the tier rather than the requested one:
+// Kubernetes only lets activeDeadlineSeconds go down once it is set, so a deadline from the
+// requested lifetime would leave no room to extend. The reaper enforces the shorter expiration, and
+// extends are capped at the tier's lifetime so they always stay inside the deadline.
+
+// WithDeadline sets activeDeadlineSeconds for a pod of tier that is about to be created
+func WithDeadline(tier Tier) PodOption {
+	return func(p *v1.Pod) {
+		seconds := int64((tier.MaxDuration.Duration + deadlineGrace).Seconds())
+		p.Spec.ActiveDeadlineSeconds = &seconds
+	}
+}
+
+// setDeadline sets activeDeadlineSeconds on a running pod of tier, from when it was handed to the
+// user. It counts from the pod's start time and is only ever lowered.
+func setDeadline(pod *v1.Pod, tier Tier) {
+	latest := podCreated(*pod).Add(tier.MaxDuration.Duration + deadlineGrace)
+	seconds := int64(latest.Sub(podStarted(*pod)).Seconds())
+	if pod.Spec.ActiveDeadlineSeconds == nil || *pod.Spec.ActiveDeadlineSeconds > seconds {
+		pod.Spec.ActiveDeadlineSeconds = &seconds
+	}
+}
+
+// podStarted is what activeDeadlineSeconds counts from
+func podStarted(pod v1.Pod) time.Time {
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time
+	}
+	if !pod.CreationTimestamp.IsZero() {
+		return pod.CreationTimestamp.Time
+	}
+	return podCreated(pod)
+}
+
+// podCreated is when the instance was handed to the user, which for pool pods is the claim time
+func podCreated(pod v1.Pod) time.Time {
+	if created, err := time.Parse(time.RFC3339, pod.Annotations["app.trashdb/created"]); err == nil {
+		return created
+	}
+	return pod.CreationTimestamp.Time
+}
+
+// ExtendPod pushes the expiration of a pod back, up to the longest lifetime of its tier
+func ExtendPod(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string, extra time.Duration) (*v1.Pod, error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	pod, err := extendPod(ctx, client, namespace, podName, podSecret, extra)
+	extendsTotal.WithLabelValues(result(err)).Inc()
+	details := map[string]any{"extra": extra.String()}
+	if err == nil {
+		details["expiration"] = pod.Annotations["app.trashdb/expiration"]
+	}
+	audit(ctx, AuditExtend, podName, result(err), err, details)
+	return pod, err
+}
+
+func extendPod(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string, extra time.Duration) (*v1.Pod, error) {
+	if extra <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+
+	pod, err := findOwnPod(ctx, client, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	if matches, ok := secretMatches(*pod, podSecret); !ok || !matches {
+		return nil, fmt.Errorf("Wrong secret")
+	}
+
+	expiration, err := PodExpiration(*pod)
+	if err != nil {
+		return nil, err
+	}
+	_, tier, err := LookupTier(pod.Labels["app.trashdb/tier"])
+	if err != nil {
+		return nil, err
+	}
+
+	created := podCreated(*pod)
+	newExpiration := expiration.Add(extra)
+	if newExpiration.Sub(created) > tier.MaxDuration.Duration {
+		return nil, fmt.Errorf("instance can live at most %d minutes, it expires at %s at the latest", int(tier.MaxDuration.Minutes()), created.Add(tier.MaxDuration.Duration).Format(time.RFC3339))
+	}
+
+	pod.Annotations["app.trashdb/expiration"] = newExpiration.Format(time.RFC3339)
+	// pods from before deadlines get one now
+	setDeadline(pod, tier)
+
+	updated, err := client.UpdatePod(ctx, namespace, pod)
+	if err != nil {
+		return nil, err
+	}
+	logger(ctx).Info().Msgf("Extended pod until %s", newExpiration.Format(time.RFC3339))
+	recordEvent(ctx, updated, v1.EventTypeNormal, EventExtended, "Extended by %s until %s", extra, newExpiration.Format(time.RFC3339))
+	return updated, nil
+}
+
+// Reconcile is the startup pass: it fills the pod cache, deletes whatever expired while TrashDB was
+// down and brings older pods up to date: they get a deadline and a hashed secret
+func Reconcile(ctx context.Context, client KubernetesClient, namespace string) error {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	pods, err := ListPods(ctx, client, namespace)
+	if err != nil {
+		return err
+	}
+	deleteExpiredPods(ctx, client, namespace)
+
+	var updated int
+	for _, pod := range pods.Items {
+		if isIdlePoolPod(pod) || expirationProblem(pod) != "" || ReapReason(pod) != "" {
+			continue
+		}
+		changed := hashSecret(&pod)
+		if pod.Spec.ActiveDeadlineSeconds == nil {
+			if _, tier, err := LookupTier(pod.Labels["app.trashdb/tier"]); err == nil {
+				setDeadline(&pod, tier)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if _, err := client.UpdatePod(ctx, namespace, &pod); err != nil {
+			log.Error().Err(err).Str("podName", instanceName(pod)).Msg("Failed to reconcile pod")
+			continue
+		}
+		updated++
+	}
+
+	log.Info().Msgf("Reconciled %d pods, updated %d", len(pods.Items), updated)
+	return nil
+}
+
+func ReconcilePods(ctx context.Context, namespace string) error {
+	return Reconcile(ctx, nil, namespace)
+}
+
+// createdAnnotation stamps when the instance was handed to the user
+func createdAnnotation(now time.Time) map[string]string {
+	return map[string]string{"app.trashdb/created": now.Format(time.RFC3339)}
+}
@@ -0,0 +1,78 @@
+package trashdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Every API request gets an ID and a logger carrying it, the route and the client IP. Code on the
+// request path logs through logger(ctx) so its lines can be tied back to the request, code running
+// in the event loop falls back to the global logger.
+
+const requestIDHeader = "X-Request-ID"
+
+// request IDs from callers are only reused when they are short and boring enough to log safely
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// withRequestContext sets up the request ID, request metadata and logger for a handler
+func withRequestContext(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		meta := RequestMeta{RequestID: requestID, ClientIP: ClientIP(r)}
+		fields := log.With().Str("requestId", requestID).Str("route", route).Str("clientIp", meta.ClientIP)
+		if traceID := TraceID(r.Context()); traceID != "" {
+			fields = fields.Str("traceId", traceID)
+		}
+		l := fields.Logger()
+
+		ctx := l.WithContext(WithRequestMeta(r.Context(), meta))
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// logger returns the logger for the request in ctx, or the global logger outside a request
+func logger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
+
+// withPodName adds the pod name to the request's log lines from here on
+func withPodName(ctx context.Context, podName string) {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str("podName", podName)
+		})
+	}
+}
+
+// queuedContext is the context a queued create runs in once it comes off the waitlist, so it is
+// still logged and audited under the request that queued it
+func queuedContext(ctx context.Context, req *CreateRequest) context.Context {
+	l := log.With().
+		Str("requestId", req.requester.RequestID).
+		Str("clientIp", req.requester.ClientIP).
+		Str("podName", req.PodName).
+		Logger()
+	return l.WithContext(WithRequestMeta(ctx, req.requester))
+}
@@ -0,0 +1,132 @@
+package trashdb
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Metrics live in their own registry, served on /metrics next to the Go runtime and process metrics
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	registry.MustRegister(c)
+	return c
+}
+
+func newGauge(name, help string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	registry.MustRegister(g)
+	return g
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	registry.MustRegister(h)
+	return h
+}
+
+// newGaugeFunc registers a gauge worked out at scrape time. collect returns the value for each set
+// of label values joined with labelKey, series it leaves out aren't exported.
+func newGaugeFunc(name, help string, collect func() map[string]float64, labels ...string) prometheus.Collector {
+	g := &gaugeFunc{desc: prometheus.NewDesc(name, help, labels, nil), collect: collect}
+	registry.MustRegister(g)
+	return g
+}
+
+type gaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func() map[string]float64
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	for key, value := range g.collect() {
+		var labelValues []string
+		if key != "" {
+			labelValues = strings.Split(key, "\x00")
+		}
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, labelValues...)
+	}
+}
+
+// labelKey joins label values into the key gauge funcs return values under
+func labelKey(labelValues ...string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+var (
+	latencyBuckets = prometheus.DefBuckets
+	startupBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300}
+)
+
+// result is the result label for an operation that returned err. Errors from the API server are
+// failures, anything else (wrong secret, unknown instance...) means the request itself was invalid.
+func result(err error) string {
+	var status apierrors.APIStatus
+	switch {
+	case err == nil:
+		return "success"
+	case apierrors.IsNotFound(err):
+		return "invalid"
+	case errors.As(err, &status):
+		return "failure"
+	default:
+		return "invalid"
+	}
+}
+
+var (
+	httpRequestDuration = newHistogramVec("trashdb_http_request_duration_seconds",
+		"API latency by route and status code.", latencyBuckets, "route", "code")
+	websocketClients = newGauge("trashdb_websocket_clients", "Connected /list_pod websocket clients.")
+)
+
+// instrument records the latency of a handler. Websockets are long-lived, they are counted by
+// trashdb_websocket_clients instead.
+func instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler(recorder, r)
+		httpRequestDuration.WithLabelValues(route, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+var metricsHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+// MetricsHandler serves the metrics in the Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return metricsHandler
+}
+
+func metricsRequest(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
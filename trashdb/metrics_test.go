@@ -0,0 +1,114 @@
+package trashdb_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+)
+
+// scrape reads /metrics into samples keyed like name{label="value",...}, histograms by their count
+func scrape(t *testing.T) map[string]float64 {
+	recorder := httptest.NewRecorder()
+	trashdb.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from /metrics, got %d", recorder.Code)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse /metrics: %v", err)
+	}
+	samples := map[string]float64{}
+	for name, family := range families {
+		for _, metric := range family.Metric {
+			var labels []string
+			for _, label := range metric.Label {
+				labels = append(labels, label.GetName()+`="`+label.GetValue()+`"`)
+			}
+			sort.Strings(labels)
+			key := name
+			if len(labels) > 0 {
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case metric.Counter != nil:
+				samples[key] = metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				samples[key] = metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				samples[key] = float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	withRecorder(t)
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	ctx := context.Background()
+	before := scrape(t)
+
+	if _, _, err := trashdb.AdmitPod(ctx, client, "namespace-123", trashdb.CreateRequest{
+		ClientID:  "10.0.0.1",
+		PodName:   "pod-123",
+		PodSecret: exampleSecret,
+		Tier:      "small",
+		Duration:  10 * time.Minute,
+	}, false); err != nil {
+		t.Fatalf("Unexpected error creating pod: %v", err)
+	}
+	trashdb.UpdatePodsCache(&v1.PodList{Items: cluster.pods})
+	ready := cluster.pods[0].DeepCopy()
+	ready.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	trashdb.UpdatePodsCache(&v1.PodList{Items: []v1.Pod{*ready}})
+
+	if _, err := trashdb.ExtendPod(ctx, client, "namespace-123", "pod-123", exampleSecret, 5*time.Minute); err != nil {
+		t.Fatalf("Unexpected error extending pod: %v", err)
+	}
+	if _, err := trashdb.ExtendPod(ctx, client, "namespace-123", "pod-123", "wrong-secret", 5*time.Minute); err == nil {
+		t.Fatalf("Expected extending with the wrong secret to fail")
+	}
+	if err := trashdb.DeletePodWithSecret(ctx, client, "namespace-123", "pod-123", exampleSecret); err != nil {
+		t.Fatalf("Unexpected error deleting pod: %v", err)
+	}
+	trashdb.Reap(ctx, client, "namespace-123", nil, false)
+
+	after := scrape(t)
+	increased := []string{
+		`trashdb_creates_total{result="success"}`,
+		`trashdb_extends_total{result="success"}`,
+		`trashdb_extends_total{result="invalid"}`,
+		`trashdb_deletes_total{reason="user",result="success"}`,
+		`trashdb_create_to_ready_seconds{tier="small"}`,
+		`trashdb_reaper_runs_total{dry_run="false"}`,
+	}
+	for _, series := range increased {
+		if after[series] != before[series]+1 {
+			t.Errorf("Expected %s to go up by 1, went from %v to %v", series, before[series], after[series])
+		}
+	}
+
+	present := []string{
+		"trashdb_reaper_last_run_timestamp_seconds",
+		"trashdb_reaper_backlog",
+		"trashdb_websocket_clients",
+		"trashdb_pods_cache_age_seconds",
+		`trashdb_active_instances{engine="redis",tier="small"}`,
+	}
+	for _, series := range present {
+		if _, ok := after[series]; !ok {
+			t.Errorf("Expected %s to be exported", series)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package trashdb
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Each instance pod, pool pods included, gets a NetworkPolicy of its own that only lets the
+// gateway (TrashDB itself or a proxy in front of Redis) and the allowed namespaces connect, and
+// stops the pod from connecting anywhere but DNS, so REPLICAOF and MIGRATE can't be pointed at
+// internal hosts. The policy is owned like any other dependent and goes away with the instance.
+
+// podLabel selects a single pod for its policy. Instance pods are named after the instance, but
+// the name label moves when a pool pod is claimed and pods have no label for their own name.
+const podLabel = "app.trashdb/pod"
+
+// namespaceNameLabel is set on every namespace by Kubernetes
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+func withPodLabel(name string) PodOption {
+	return WithLabels(map[string]string{podLabel: name})
+}
+
+func instanceNetworkPolicy(namespace string, pod *v1.Pod) *networkingv1.NetworkPolicy {
+	c := config.NetworkPolicy
+
+	gateway := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: c.GatewaySelector},
+	}
+	if c.GatewayNamespace != "" {
+		gateway.NamespaceSelector = namespaceSelector(c.GatewayNamespace)
+	}
+	from := []networkingv1.NetworkPolicyPeer{gateway}
+	if len(c.AllowedNamespaces) > 0 {
+		from = append(from, networkingv1.NetworkPolicyPeer{NamespaceSelector: namespaceSelector(c.AllowedNamespaces...)})
+	}
+
+	tcp, udp := v1.ProtocolTCP, v1.ProtocolUDP
+	redis, dns := intstr.FromInt32(redisPort), intstr.FromInt32(53)
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: dependentMeta(namespace, pod.Name, pod.Labels["app.trashdb/name"], rootOwner(pod)),
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{podLabel: pod.Labels[podLabel]}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From:  from,
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &redis}},
+			}},
+			Egress: []networkingv1.NetworkPolicyEgressRule{{
+				To: []networkingv1.NetworkPolicyPeer{{NamespaceSelector: namespaceSelector(c.DNSNamespace)}},
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Protocol: &udp, Port: &dns},
+					{Protocol: &tcp, Port: &dns},
+				},
+			}},
+		},
+	}
+}
+
+func namespaceSelector(namespaces ...string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key:      namespaceNameLabel,
+		Operator: metav1.LabelSelectorOpIn,
+		Values:   namespaces,
+	}}}
+}
+
+// ensureNetworkPolicy creates the pod's policy when network policies are turned on
+func ensureNetworkPolicy(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod) error {
+	if !config.NetworkPolicy.Enabled {
+		return nil
+	}
+	_, err := client.CreateNetworkPolicy(ctx, namespace, instanceNetworkPolicy(namespace, pod))
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package trashdb_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestNetworkPolicies(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.NetworkPolicy.Enabled = true
+	config.NetworkPolicy.AllowedNamespaces = []string{"ci"}
+	config.Pool = []trashdb.PoolConfig{{Tier: "small", Size: 1}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	if _, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	(&trashdb.Pool{}).Refill(context.Background(), client, "namespace-123")
+
+	if len(cluster.pods) != 2 || len(cluster.policies) != 2 {
+		t.Fatalf("Expected 2 pods with a policy each, got %d pods and %d policies", len(cluster.pods), len(cluster.policies))
+	}
+	for _, pod := range cluster.pods {
+		var selecting []string
+		for _, policy := range cluster.policies {
+			selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+			if err != nil {
+				t.Fatalf("Invalid selector: %v", err)
+			}
+			if selector.Matches(labels.Set(pod.Labels)) {
+				selecting = append(selecting, policy.Name)
+			}
+		}
+		if diff := cmp.Diff([]string{pod.Name}, selecting); diff != "" {
+			t.Errorf("Policies selecting %s mismatch (-expected +got):\n%s", pod.Name, diff)
+		}
+	}
+
+	policy := cluster.policies[0]
+	if owners := policy.OwnerReferences; len(owners) != 1 || owners[0].Kind != "Pod" || owners[0].Name != "pod-123" {
+		t.Errorf("Expected the policy to be owned by its pod, got %v", owners)
+	}
+	if diff := cmp.Diff([]networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}, policy.Spec.PolicyTypes); diff != "" {
+		t.Errorf("Policy types mismatch (-expected +got):\n%s", diff)
+	}
+
+	var from []string
+	for _, peer := range policy.Spec.Ingress[0].From {
+		from = append(from, fmt.Sprintf("pods=%v namespaces=%v", selectorString(peer.PodSelector), selectorString(peer.NamespaceSelector)))
+	}
+	expectedFrom := []string{
+		"pods=app.kubernetes.io/name=trashdb namespaces=",
+		"pods= namespaces=kubernetes.io/metadata.name in (ci)",
+	}
+	if diff := cmp.Diff(expectedFrom, from); diff != "" {
+		t.Errorf("Ingress mismatch (-expected +got):\n%s", diff)
+	}
+
+	if len(policy.Spec.Egress) != 1 {
+		t.Fatalf("Expected a single egress rule, got %v", policy.Spec.Egress)
+	}
+	for _, port := range policy.Spec.Egress[0].Ports {
+		if port.Port.IntValue() != 53 {
+			t.Errorf("Expected egress to DNS only, got port %s", port.Port)
+		}
+	}
+	if to := selectorString(policy.Spec.Egress[0].To[0].NamespaceSelector); to != "kubernetes.io/metadata.name in (kube-system)" {
+		t.Errorf("Expected egress to kube-system only, got %q", to)
+	}
+}
+
+func TestNetworkPolicyFailure(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.NetworkPolicy.Enabled = true
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	client.CreateNetworkPolicyFunc = func(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error) {
+		return nil, fmt.Errorf("networkpolicies is forbidden")
+	}
+
+	_, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute)
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if len(cluster.pods) != 0 {
+		t.Errorf("Expected the pod to be deleted, got %d pods", len(cluster.pods))
+	}
+}
+
+func selectorString(selector *metav1.LabelSelector) string {
+	if selector == nil {
+		return ""
+	}
+	s, _ := metav1.LabelSelectorAsSelector(selector)
+	return s.String()
+}
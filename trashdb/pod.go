@@ -2,15 +2,59 @@ package trashdb
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// MinDuration is the shortest lifetime any instance can be created with
+const MinDuration = 10 * time.Minute
+
+const managedBySelector = "app.kubernetes.io/managed-by=trashdb"
+
+var deletesTotal = newCounterVec("trashdb_deletes_total",
+	"Instance deletes by reason (user, expired or failed) and result (success, failure or invalid).", "reason", "result")
+
+// Pods only keep a hash of the instance secret, their annotations go to anyone who can list pods.
+// Pods from before that have it in plain text until Reconcile hashes it.
+const (
+	secretHashAnnotation   = "app.trashdb/secret-hash"
+	legacySecretAnnotation = "app.trashdb/secret"
+)
+
+// secretMatches checks secret against the one the pod was created with, ok is false for pods
+// that have none
+func secretMatches(pod v1.Pod, secret string) (matches, ok bool) {
+	if hash, ok := pod.Annotations[secretHashAnnotation]; ok {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(passwordHash(secret))) == 1, true
+	}
+	if plain, ok := pod.Annotations[legacySecretAnnotation]; ok {
+		return subtle.ConstantTimeCompare([]byte(plain), []byte(secret)) == 1, true
+	}
+	return false, false
+}
+
+// hashSecret swaps a plain text secret on the pod for its hash and reports whether there was one
+func hashSecret(pod *v1.Pod) bool {
+	plain, ok := pod.Annotations[legacySecretAnnotation]
+	if !ok {
+		return false
+	}
+	delete(pod.Annotations, legacySecretAnnotation)
+	pod.Annotations[secretHashAnnotation] = passwordHash(plain)
+	return true
+}
+
+// DefaultEngine is the only engine there is a pod template for so far
+const DefaultEngine = "redis"
+
 type PodOption func(*v1.Pod)
 
 func WithLabels(labels map[string]string) PodOption {
@@ -27,6 +71,12 @@ func WithName(name string) PodOption {
 	}
 }
 
+func WithGenerateName(prefix string) PodOption {
+	return func(p *v1.Pod) {
+		p.GenerateName = prefix
+	}
+}
+
 func WithNamespace(namespace string) PodOption {
 	return func(p *v1.Pod) {
 		p.Name = namespace
@@ -41,6 +91,15 @@ func WithAnnotations(annotations map[string]string) PodOption {
 	}
 }
 
+// WithRuntimeClass runs the pod under a RuntimeClass such as gVisor, an empty name keeps the default
+func WithRuntimeClass(name string) PodOption {
+	return func(p *v1.Pod) {
+		if name != "" {
+			p.Spec.RuntimeClassName = &name
+		}
+	}
+}
+
 func NewPod(options ...PodOption) *v1.Pod {
 	pod := RedisPodTemplate.DeepCopy()
 	for _, opt := range options {
@@ -49,6 +108,13 @@ func NewPod(options ...PodOption) *v1.Pod {
 	return pod
 }
 
+// redisUID is the redis user and group of the official image
+const redisUID int64 = 999
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
 var RedisPodTemplate = &v1.Pod{
 	TypeMeta: metav1.TypeMeta{
 		APIVersion: "v1",
@@ -64,7 +130,26 @@ var RedisPodTemplate = &v1.Pod{
 		},
 		Annotations: map[string]string{},
 	},
+	// Instances run code from anyone, so the pod gets as little as Redis can live with: no
+	// service account token, no root, no capabilities and nothing writable but /data.
 	Spec: v1.PodSpec{
+		AutomountServiceAccountToken: ptrTo(false),
+		EnableServiceLinks:           ptrTo(false),
+		SecurityContext: &v1.PodSecurityContext{
+			RunAsNonRoot: ptrTo(true),
+			RunAsUser:    ptrTo(redisUID),
+			RunAsGroup:   ptrTo(redisUID),
+			FSGroup:      ptrTo(redisUID),
+			SeccompProfile: &v1.SeccompProfile{
+				Type: v1.SeccompProfileTypeRuntimeDefault,
+			},
+		},
+		Volumes: []v1.Volume{
+			v1.Volume{
+				Name:         "data",
+				VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+			},
+		},
 		Containers: []v1.Container{
 			v1.Container{
 				Name:  "redis",
@@ -74,6 +159,19 @@ var RedisPodTemplate = &v1.Pod{
 						ContainerPort: 6379,
 					},
 				},
+				SecurityContext: &v1.SecurityContext{
+					AllowPrivilegeEscalation: ptrTo(false),
+					ReadOnlyRootFilesystem:   ptrTo(true),
+					Capabilities: &v1.Capabilities{
+						Drop: []v1.Capability{"ALL"},
+					},
+				},
+				VolumeMounts: []v1.VolumeMount{
+					v1.VolumeMount{
+						Name:      "data",
+						MountPath: "/data",
+					},
+				},
 				Resources: v1.ResourceRequirements{
 					Requests: v1.ResourceList{
 						v1.ResourceCPU:    resource.MustParse("500m"),
@@ -89,38 +187,100 @@ var RedisPodTemplate = &v1.Pod{
 	},
 }
 
-func CreatePod(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string, duration time.Duration) (*v1.Pod, error) {
+func CreatePod(ctx context.Context, client KubernetesClient, namespace, podName, podSecret, tierName string, duration time.Duration, options ...PodOption) (*v1.Pod, error) {
 	if client == nil {
 		client = &RealKubernetesClient{}
 	}
 
-	if namespace == "" {
-		return nil, fmt.Errorf("required: namespace")
-	}
-	if len(podName) < 7 {
-		return nil, fmt.Errorf("pod name must be at least 7 characters")
+	tierName, tier, err := ValidateCreate(namespace, podName, podSecret, tierName, duration)
+	if err != nil {
+		return nil, err
 	}
-	if len(podSecret) < 30 {
-		return nil, fmt.Errorf("pod secret must be at least 30 characters")
+	if err := CheckQuota(ctx, client, namespace, tierName, tier); err != nil {
+		return nil, err
 	}
 
-	// TODO: allow min, max duration to be configurable using env var
-	if duration < 10*time.Minute || duration > 60*time.Minute {
-		return nil, fmt.Errorf("duration must be between 10 and 60 minutes")
+	if config.TLS.Enabled {
+		options = append(options, withTLS(podName))
 	}
-
-	data := NewPod(
+	data := NewPod(append([]PodOption{
 		WithNamespace(namespace),
 		WithName(podName),
 		WithLabels(map[string]string{
 			"app.kubernetes.io/instance": "redis-" + podName,
+			"app.trashdb/name":           podName,
 		}),
 		WithAnnotations(map[string]string{
 			"app.trashdb/expiration": time.Now().Add(duration).Format(time.RFC3339),
-			"app.trashdb/secret":     podSecret,
-		}))
+			secretHashAnnotation:     passwordHash(podSecret),
+		}),
+		WithAnnotations(createdAnnotation(time.Now())),
+		WithTier(tierName, tier),
+		WithDeadline(tier),
+		WithRuntimeClass(config.RuntimeClassName),
+		WithACL(podName),
+		withPodLabel(podName),
+	}, options...)...)
 
-	return client.CreatePod(ctx, namespace, data)
+	pod, err := client.CreatePod(ctx, namespace, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureACL(ctx, client, namespace, pod, tier, podSecret); err != nil {
+		client.DeletePod(ctx, namespace, pod.Name)
+		return nil, fmt.Errorf("failed to create ACL: %w", err)
+	}
+	if err := ensureNetworkPolicy(ctx, client, namespace, pod); err != nil {
+		// an instance nobody can firewall isn't handed out
+		client.DeletePod(ctx, namespace, pod.Name)
+		return nil, fmt.Errorf("failed to create network policy: %w", err)
+	}
+	if err := ensureTLS(ctx, client, namespace, pod, tier); err != nil {
+		client.DeletePod(ctx, namespace, pod.Name)
+		return nil, fmt.Errorf("failed to set up TLS: %w", err)
+	}
+	return pod, nil
+}
+
+// ValidateCreate checks the create parameters and resolves the tier
+func ValidateCreate(namespace, podName, podSecret, tierName string, duration time.Duration) (string, Tier, error) {
+	if namespace == "" {
+		return "", Tier{}, fmt.Errorf("required: namespace")
+	}
+	if len(podName) < 7 {
+		return "", Tier{}, fmt.Errorf("pod name must be at least 7 characters")
+	}
+	if err := validatePodName(podName); err != nil {
+		return "", Tier{}, err
+	}
+	if len(podSecret) < 30 {
+		return "", Tier{}, fmt.Errorf("pod secret must be at least 30 characters")
+	}
+
+	tierName, tier, err := LookupTier(tierName)
+	if err != nil {
+		return "", Tier{}, err
+	}
+	if duration < MinDuration || duration > tier.MaxDuration.Duration {
+		return "", Tier{}, fmt.Errorf("duration must be between %d and %d minutes", int(MinDuration.Minutes()), int(tier.MaxDuration.Minutes()))
+	}
+	return tierName, tier, nil
+}
+
+// maxPodNameLength leaves room for the redis- prefix of the instance label, label values are at
+// most 63 characters
+const maxPodNameLength = validation.DNS1123LabelMaxLength - len("redis-")
+
+// validatePodName checks a name the user gave before it is used in a label selector or object
+// name. Instance names also become Service names, which have to start with a letter.
+func validatePodName(podName string) error {
+	if len(podName) > maxPodNameLength {
+		return fmt.Errorf("pod name must be at most %d characters", maxPodNameLength)
+	}
+	if errs := validation.IsDNS1035Label(podName); len(errs) > 0 {
+		return fmt.Errorf("pod name must be a DNS label: lowercase letters, digits and '-', starting with a letter")
+	}
+	return nil
 }
 
 func ListPods(ctx context.Context, client KubernetesClient, namespace string) (*v1.PodList, error) {
@@ -129,10 +289,10 @@ func ListPods(ctx context.Context, client KubernetesClient, namespace string) (*
 	}
 
 	newPods, err := client.ListPods(ctx, namespace, metav1.ListOptions{
-		LabelSelector: "app.kubernetes.io/managed-by=trashdb",
+		LabelSelector: managedBySelector,
 	})
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to list pods")
+		logger(ctx).Error().Err(err).Msg("Failed to list pods")
 		return nil, err
 	}
 
@@ -156,16 +316,32 @@ func DeletePodWithSecret(ctx context.Context, client KubernetesClient, namespace
 		client = &RealKubernetesClient{}
 	}
 
-	pod, err := client.GetPod(ctx, namespace, podName)
+	err := deletePodWithSecret(ctx, client, namespace, podName, podSecret)
+	deletesTotal.WithLabelValues("user", result(err)).Inc()
+	audit(ctx, AuditDelete, podName, result(err), err, nil)
+	return err
+}
+
+func deletePodWithSecret(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string) error {
+	pod, err := findOwnPod(ctx, client, namespace, podName)
 	if err != nil {
+		// the controller may not have created the pod yet
+		if config.Controller.Enabled && apierrors.IsNotFound(err) {
+			return deleteInstanceWithSecret(ctx, client, namespace, podName, podSecret)
+		}
 		return err
 	}
 
-	if actualSecret, ok := pod.Annotations["app.trashdb/secret"]; ok && podSecret != actualSecret {
+	if matches, ok := secretMatches(*pod, podSecret); !ok || !matches {
 		return fmt.Errorf("Wrong secret")
 	}
 
-	return client.DeletePod(ctx, namespace, podName)
+	if err := deleteInstanceOrPod(ctx, client, namespace, *pod); err != nil {
+		return err
+	}
+	logger(ctx).Info().Msg("Pod deleted")
+	recordEvent(ctx, pod, v1.EventTypeNormal, EventDeleted, "Instance %s deleted by its owner", podName)
+	return nil
 }
 
 func GetPod(ctx context.Context, client KubernetesClient, namespace, podName string) (*v1.Pod, error) {
@@ -173,7 +349,7 @@ func GetPod(ctx context.Context, client KubernetesClient, namespace, podName str
 		client = &RealKubernetesClient{}
 	}
 
-	return client.GetPod(ctx, namespace, podName)
+	return findOwnPod(ctx, client, namespace, podName)
 }
 
 func PodExpiration(pod v1.Pod) (*time.Time, error) {
@@ -188,6 +364,10 @@ func PodExpiration(pod v1.Pod) (*time.Time, error) {
 }
 
 func IsExpired(pod v1.Pod) bool {
+	// idle pool pods have no expiration until they are claimed
+	if isIdlePoolPod(pod) {
+		return false
+	}
 	expiration, err := PodExpiration(pod)
 	if err != nil {
 		return true
@@ -195,24 +375,32 @@ func IsExpired(pod v1.Pod) bool {
 	return time.Now().After(*expiration)
 }
 
+// ReapReason says why the reaper should delete a pod, or "" if it should be left alone
+func ReapReason(pod v1.Pod) string {
+	// pods without a usable expiration are up to the expiration policy
+	if expirationProblem(pod) != "" {
+		return ""
+	}
+	if IsExpired(pod) {
+		return "expired"
+	}
+	grace := config.FailureGracePeriod.Duration
+	if reason, since, ok := PodFailure(pod); ok && grace > 0 && time.Since(since) > grace {
+		return fmt.Sprintf("failed: %s for more than %s", reason, grace)
+	}
+	return ""
+}
+
 // TODO: should this be a method of KubernetesClient?
 func DeleteExpiredPods(ctx context.Context, namespace string) {
+	deleteExpiredPods(ctx, nil, namespace)
+}
+
+func deleteExpiredPods(ctx context.Context, client KubernetesClient, namespace string) {
 	if podsCache == nil {
 		return
 	}
 
-	var success, failures int
-	for _, pod := range podsCache.Items {
-		if IsExpired(pod) {
-			if err := DeletePod(ctx, nil, namespace, pod.Name); err != nil {
-				failures++
-			} else {
-				success++
-			}
-		}
-	}
-	total := success + failures
-	if total > 0 {
-		log.Info().Msgf("Attempted to clean up %d pods, %d success, %d failures", total, success, failures)
-	}
+	report := Reap(ctx, client, namespace, podsCache.Items, config.Reaper.DryRun)
+	lastReapReport.Store(&report)
 }
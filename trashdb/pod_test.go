@@ -3,12 +3,15 @@ package trashdb_test
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/taimoorgit/trashdb/trashdb"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -18,9 +21,25 @@ var exampleSecret = "dUjplFcUO5Zxnmm8WlJjkV0Tll4jUj"
 // MockKubernetesClient with embedded behavior as methods
 type MockKubernetesClient struct {
 	CreatePodFunc func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)
+	UpdatePodFunc func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)
 	ListPodsFunc  func(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error)
 	DeletePodFunc func(ctx context.Context, namespace, podName string) error
 	GetPodFunc    func(ctx context.Context, namespace, podName string) (*v1.Pod, error)
+
+	ListResourceQuotasFunc func(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error)
+	ListDependentsFunc     func(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) ([]metav1.ObjectMeta, error)
+	DeleteDependentFunc    func(ctx context.Context, namespace, kind, name string) error
+
+	CreateServiceFunc        func(ctx context.Context, namespace string, service *v1.Service) (*v1.Service, error)
+	CreateSecretFunc         func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)
+	CreateNetworkPolicyFunc  func(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error)
+	GetSecretFunc            func(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	UpdateSecretFunc         func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)
+	ListInstancesFunc        func(ctx context.Context, namespace string) ([]trashdb.TrashInstance, error)
+	GetInstanceFunc          func(ctx context.Context, namespace, name string) (*trashdb.TrashInstance, error)
+	CreateInstanceFunc       func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error)
+	UpdateInstanceStatusFunc func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error)
+	DeleteInstanceFunc       func(ctx context.Context, namespace, name string) error
 }
 
 // Implement the interface methods by delegating to the function fields
@@ -31,6 +50,13 @@ func (m *MockKubernetesClient) CreatePod(ctx context.Context, namespace string,
 	panic("CreatePod not implemented")
 }
 
+func (m *MockKubernetesClient) UpdatePod(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+	if m.UpdatePodFunc != nil {
+		return m.UpdatePodFunc(ctx, namespace, pod)
+	}
+	panic("UpdatePod not implemented")
+}
+
 func (m *MockKubernetesClient) ListPods(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error) {
 	if m.ListPodsFunc != nil {
 		return m.ListPodsFunc(ctx, namespace, listOptions)
@@ -52,6 +78,97 @@ func (m *MockKubernetesClient) GetPod(ctx context.Context, namespace, podName st
 	panic("GetPod not implemented")
 }
 
+func (m *MockKubernetesClient) ListResourceQuotas(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error) {
+	if m.ListResourceQuotasFunc != nil {
+		return m.ListResourceQuotasFunc(ctx, namespace)
+	}
+	panic("ListResourceQuotas not implemented")
+}
+
+func (m *MockKubernetesClient) ListDependents(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+	if m.ListDependentsFunc != nil {
+		return m.ListDependentsFunc(ctx, namespace, kind, listOptions)
+	}
+	panic("ListDependents not implemented")
+}
+
+func (m *MockKubernetesClient) DeleteDependent(ctx context.Context, namespace, kind, name string) error {
+	if m.DeleteDependentFunc != nil {
+		return m.DeleteDependentFunc(ctx, namespace, kind, name)
+	}
+	panic("DeleteDependent not implemented")
+}
+
+func (m *MockKubernetesClient) CreateService(ctx context.Context, namespace string, service *v1.Service) (*v1.Service, error) {
+	if m.CreateServiceFunc != nil {
+		return m.CreateServiceFunc(ctx, namespace, service)
+	}
+	panic("CreateService not implemented")
+}
+
+func (m *MockKubernetesClient) CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+	if m.CreateSecretFunc != nil {
+		return m.CreateSecretFunc(ctx, namespace, secret)
+	}
+	panic("CreateSecret not implemented")
+}
+
+func (m *MockKubernetesClient) CreateNetworkPolicy(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error) {
+	if m.CreateNetworkPolicyFunc != nil {
+		return m.CreateNetworkPolicyFunc(ctx, namespace, policy)
+	}
+	panic("CreateNetworkPolicy not implemented")
+}
+
+func (m *MockKubernetesClient) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	if m.GetSecretFunc != nil {
+		return m.GetSecretFunc(ctx, namespace, name)
+	}
+	panic("GetSecret not implemented")
+}
+
+func (m *MockKubernetesClient) UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+	if m.UpdateSecretFunc != nil {
+		return m.UpdateSecretFunc(ctx, namespace, secret)
+	}
+	panic("UpdateSecret not implemented")
+}
+
+func (m *MockKubernetesClient) ListInstances(ctx context.Context, namespace string) ([]trashdb.TrashInstance, error) {
+	if m.ListInstancesFunc != nil {
+		return m.ListInstancesFunc(ctx, namespace)
+	}
+	panic("ListInstances not implemented")
+}
+
+func (m *MockKubernetesClient) GetInstance(ctx context.Context, namespace, name string) (*trashdb.TrashInstance, error) {
+	if m.GetInstanceFunc != nil {
+		return m.GetInstanceFunc(ctx, namespace, name)
+	}
+	panic("GetInstance not implemented")
+}
+
+func (m *MockKubernetesClient) CreateInstance(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error) {
+	if m.CreateInstanceFunc != nil {
+		return m.CreateInstanceFunc(ctx, namespace, instance)
+	}
+	panic("CreateInstance not implemented")
+}
+
+func (m *MockKubernetesClient) UpdateInstanceStatus(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error) {
+	if m.UpdateInstanceStatusFunc != nil {
+		return m.UpdateInstanceStatusFunc(ctx, namespace, instance)
+	}
+	panic("UpdateInstanceStatus not implemented")
+}
+
+func (m *MockKubernetesClient) DeleteInstance(ctx context.Context, namespace, name string) error {
+	if m.DeleteInstanceFunc != nil {
+		return m.DeleteInstanceFunc(ctx, namespace, name)
+	}
+	panic("DeleteInstance not implemented")
+}
+
 // Option pattern for setting mock behaviors
 type MockOption func(*MockKubernetesClient)
 
@@ -61,6 +178,12 @@ func WithCreatePodFunc(f func(ctx context.Context, namespace string, pod *v1.Pod
 	}
 }
 
+func WithUpdatePodFunc(f func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.UpdatePodFunc = f
+	}
+}
+
 func WithListPodsFunc(f func(ctx context.Context, namespace string, listOptions metav1.ListOptions) (*v1.PodList, error)) MockOption {
 	return func(m *MockKubernetesClient) {
 		m.ListPodsFunc = f
@@ -79,6 +202,84 @@ func WithGetPodFunc(f func(ctx context.Context, namespace, podName string) (*v1.
 	}
 }
 
+func WithListResourceQuotasFunc(f func(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.ListResourceQuotasFunc = f
+	}
+}
+
+func WithListDependentsFunc(f func(ctx context.Context, namespace, kind string, listOptions metav1.ListOptions) ([]metav1.ObjectMeta, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.ListDependentsFunc = f
+	}
+}
+
+func WithDeleteDependentFunc(f func(ctx context.Context, namespace, kind, name string) error) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.DeleteDependentFunc = f
+	}
+}
+
+func WithCreateServiceFunc(f func(ctx context.Context, namespace string, service *v1.Service) (*v1.Service, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.CreateServiceFunc = f
+	}
+}
+
+func WithCreateSecretFunc(f func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.CreateSecretFunc = f
+	}
+}
+
+func WithCreateNetworkPolicyFunc(f func(ctx context.Context, namespace string, policy *networkingv1.NetworkPolicy) (*networkingv1.NetworkPolicy, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.CreateNetworkPolicyFunc = f
+	}
+}
+
+func WithGetSecretFunc(f func(ctx context.Context, namespace, name string) (*v1.Secret, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.GetSecretFunc = f
+	}
+}
+
+func WithUpdateSecretFunc(f func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.UpdateSecretFunc = f
+	}
+}
+
+func WithListInstancesFunc(f func(ctx context.Context, namespace string) ([]trashdb.TrashInstance, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.ListInstancesFunc = f
+	}
+}
+
+func WithGetInstanceFunc(f func(ctx context.Context, namespace, name string) (*trashdb.TrashInstance, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.GetInstanceFunc = f
+	}
+}
+
+func WithCreateInstanceFunc(f func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.CreateInstanceFunc = f
+	}
+}
+
+func WithUpdateInstanceStatusFunc(f func(ctx context.Context, namespace string, instance *trashdb.TrashInstance) (*trashdb.TrashInstance, error)) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.UpdateInstanceStatusFunc = f
+	}
+}
+
+func WithDeleteInstanceFunc(f func(ctx context.Context, namespace, name string) error) MockOption {
+	return func(m *MockKubernetesClient) {
+		m.DeleteInstanceFunc = f
+	}
+}
+
 // Create a new mock client with options
 func NewMockKubernetesClient(opts ...MockOption) *MockKubernetesClient {
 	mock := &MockKubernetesClient{}
@@ -88,6 +289,24 @@ func NewMockKubernetesClient(opts ...MockOption) *MockKubernetesClient {
 	return mock
 }
 
+func noQuotas(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error) {
+	return &v1.ResourceQuotaList{}, nil
+}
+
+func exampleQuota(name v1.ResourceName, hard, used string) v1.ResourceQuota {
+	return v1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "trashdb"},
+		Status: v1.ResourceQuotaStatus{
+			Hard: v1.ResourceList{name: resource.MustParse(hard)},
+			Used: v1.ResourceList{name: resource.MustParse(used)},
+		},
+	}
+}
+
+func mediumTier() (string, trashdb.Tier) {
+	return "medium", trashdb.DefaultConfig().Tiers["medium"]
+}
+
 func TestGetPod(t *testing.T) {
 	type testCase struct {
 		Name        string
@@ -121,6 +340,7 @@ func TestGetPod(t *testing.T) {
 		{
 			Name:        "Get pod error",
 			Namespace:   "some error",
+			PodName:     "pod-123",
 			ExpectedPod: nil,
 			ExpectedErr: "some error",
 			MockClient: NewMockKubernetesClient(
@@ -131,6 +351,14 @@ func TestGetPod(t *testing.T) {
 				),
 			),
 		},
+		{
+			Name:        "Get pod with a name that would change the label selector",
+			Namespace:   "namespace-123",
+			PodName:     "abcdefg,app.trashdb/name!=x",
+			ExpectedPod: nil,
+			ExpectedErr: "pod name must be a DNS label: lowercase letters, digits and '-', starting with a letter",
+			MockClient:  NewMockKubernetesClient(),
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -159,6 +387,7 @@ func TestCreatePod(t *testing.T) {
 		Namespace   string
 		PodName     string
 		PodSecret   string
+		Tier        string
 		Duration    time.Duration
 		ExpectedPod *v1.Pod
 		ExpectedErr string
@@ -176,17 +405,117 @@ func TestCreatePod(t *testing.T) {
 				trashdb.WithName("pod-123"),
 				trashdb.WithLabels(map[string]string{
 					"app.kubernetes.io/instance": "redis-pod-123",
+					"app.trashdb/name":           "pod-123",
+					"app.trashdb/pod":            "pod-123",
 				}),
 				trashdb.WithAnnotations(map[string]string{
-					"app.trashdb/expiration": time.Now().Add(1 * time.Hour).Format(time.RFC3339),
-					"app.trashdb/secret":     exampleSecret,
+					"app.trashdb/expiration":  time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+					"app.trashdb/secret-hash": passwordHash(exampleSecret),
+					"app.trashdb/created":     time.Now().Format(time.RFC3339),
 				}),
+				trashdb.WithTier(mediumTier()),
+				trashdb.WithDeadline(trashdb.DefaultConfig().Tiers["medium"]),
+				trashdb.WithACL("pod-123"),
 			),
 			ExpectedErr: "",
 			MockClient: NewMockKubernetesClient(
 				WithCreatePodFunc(func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
 					return pod, nil
 				}),
+				WithCreateSecretFunc(func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+					return secret, nil
+				}),
+				WithListResourceQuotasFunc(noQuotas),
+			),
+		},
+		{
+			Name:      "Create pod success - small tier",
+			Namespace: "namespace-123",
+			PodName:   "pod-123",
+			PodSecret: exampleSecret,
+			Tier:      "small",
+			Duration:  30 * time.Minute,
+			ExpectedPod: trashdb.NewPod(
+				trashdb.WithNamespace("namespace-123"),
+				trashdb.WithName("pod-123"),
+				trashdb.WithLabels(map[string]string{
+					"app.kubernetes.io/instance": "redis-pod-123",
+					"app.trashdb/name":           "pod-123",
+					"app.trashdb/pod":            "pod-123",
+				}),
+				trashdb.WithAnnotations(map[string]string{
+					"app.trashdb/expiration":  time.Now().Add(30 * time.Minute).Format(time.RFC3339),
+					"app.trashdb/secret-hash": passwordHash(exampleSecret),
+					"app.trashdb/created":     time.Now().Format(time.RFC3339),
+				}),
+				trashdb.WithTier("small", trashdb.DefaultConfig().Tiers["small"]),
+				trashdb.WithDeadline(trashdb.DefaultConfig().Tiers["small"]),
+				trashdb.WithACL("pod-123"),
+			),
+			ExpectedErr: "",
+			MockClient: NewMockKubernetesClient(
+				WithCreatePodFunc(func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+					return pod, nil
+				}),
+				WithCreateSecretFunc(func(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+					return secret, nil
+				}),
+				WithListResourceQuotasFunc(noQuotas),
+			),
+		},
+		{
+			Name:        "Create pod failure - unknown tier",
+			Namespace:   "namespace-123",
+			PodName:     "pod-123",
+			PodSecret:   exampleSecret,
+			Tier:        "huge",
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: `unknown tier "huge"`,
+			MockClient:  NewMockKubernetesClient(),
+		},
+		{
+			Name:        "Create pod failure - duration above tier maximum",
+			Namespace:   "namespace-123",
+			PodName:     "pod-123",
+			PodSecret:   exampleSecret,
+			Tier:        "small",
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: "duration must be between 10 and 30 minutes",
+			MockClient:  NewMockKubernetesClient(),
+		},
+		{
+			Name:        "Create pod failure - quota exhausted",
+			Namespace:   "namespace-123",
+			PodName:     "pod-123",
+			PodSecret:   exampleSecret,
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: `tier "medium" needs requests.memory=256Mi but quota "trashdb" only has 128Mi of 1Gi left`,
+			MockClient: NewMockKubernetesClient(
+				WithListResourceQuotasFunc(func(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error) {
+					return &v1.ResourceQuotaList{Items: []v1.ResourceQuota{
+						exampleQuota(v1.ResourceRequestsMemory, "1Gi", "896Mi"),
+					}}, nil
+				}),
+			),
+		},
+		{
+			Name:        "Create pod failure - tier larger than quota",
+			Namespace:   "namespace-123",
+			PodName:     "pod-123",
+			PodSecret:   exampleSecret,
+			Tier:        "large",
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: `tier "large" needs limits.cpu=2 which exceeds quota "trashdb" limit of 1`,
+			MockClient: NewMockKubernetesClient(
+				WithListResourceQuotasFunc(func(ctx context.Context, namespace string) (*v1.ResourceQuotaList, error) {
+					return &v1.ResourceQuotaList{Items: []v1.ResourceQuota{
+						exampleQuota(v1.ResourceLimitsCPU, "1", "0"),
+					}}, nil
+				}),
 			),
 		},
 		{
@@ -217,6 +546,26 @@ func TestCreatePod(t *testing.T) {
 				}),
 			),
 		},
+		{
+			Name:        "Create pod failure - podName isn't a DNS label",
+			Namespace:   "namespace-123",
+			PodName:     "Pod_123.local",
+			PodSecret:   exampleSecret,
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: "pod name must be a DNS label: lowercase letters, digits and '-', starting with a letter",
+			MockClient:  NewMockKubernetesClient(),
+		},
+		{
+			Name:        "Create pod failure - podName too long",
+			Namespace:   "namespace-123",
+			PodName:     strings.Repeat("a", 58),
+			PodSecret:   exampleSecret,
+			Duration:    1 * time.Hour,
+			ExpectedPod: nil,
+			ExpectedErr: "pod name must be at most 57 characters",
+			MockClient:  NewMockKubernetesClient(),
+		},
 		{
 			Name:        "Create pod failure - no podSecret",
 			Namespace:   "namespace-123",
@@ -248,7 +597,7 @@ func TestCreatePod(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
-			got, err := trashdb.CreatePod(context.Background(), tc.MockClient, tc.Namespace, tc.PodName, tc.PodSecret, tc.Duration)
+			got, err := trashdb.CreatePod(context.Background(), tc.MockClient, tc.Namespace, tc.PodName, tc.PodSecret, tc.Tier, tc.Duration)
 
 			// Check for error match
 			if tc.ExpectedErr != "" {
@@ -300,6 +649,11 @@ func TestPodIsExpired(t *testing.T) {
 			})),
 			Expected: true,
 		},
+		{
+			Name:     "Idle pool pod",
+			Pod:      trashdb.NewPod(trashdb.WithLabels(map[string]string{"app.trashdb/pool": "idle"})),
+			Expected: false,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -310,3 +664,343 @@ func TestPodIsExpired(t *testing.T) {
 		})
 	}
 }
+
+func TestReapReason(t *testing.T) {
+	notExpired := trashdb.WithAnnotations(map[string]string{
+		"app.trashdb/expiration": time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+	})
+	crashing := func(since time.Time) v1.PodStatus {
+		return v1.PodStatus{
+			Phase: v1.PodRunning,
+			Conditions: []v1.PodCondition{{
+				Type:               v1.PodReady,
+				Status:             v1.ConditionFalse,
+				LastTransitionTime: metav1.NewTime(since),
+			}},
+			ContainerStatuses: []v1.ContainerStatus{{
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			}},
+		}
+	}
+
+	type testCase struct {
+		Name     string
+		Pod      *v1.Pod
+		Status   v1.PodStatus
+		Expected string
+	}
+	testCases := []testCase{
+		{
+			Name:     "Healthy",
+			Pod:      trashdb.NewPod(notExpired),
+			Status:   v1.PodStatus{Phase: v1.PodRunning},
+			Expected: "",
+		},
+		{
+			Name: "Expired",
+			Pod: trashdb.NewPod(trashdb.WithAnnotations(map[string]string{
+				"app.trashdb/expiration": time.Now().Add(-1 * time.Minute).Format(time.RFC3339),
+			})),
+			Expected: "expired",
+		},
+		{
+			Name:     "No expiration is left to the expiration policy",
+			Pod:      trashdb.NewPod(),
+			Expected: "",
+		},
+		{
+			Name:     "Failing within grace period",
+			Pod:      trashdb.NewPod(notExpired),
+			Status:   crashing(time.Now().Add(-1 * time.Minute)),
+			Expected: "",
+		},
+		{
+			Name:     "Failing past grace period",
+			Pod:      trashdb.NewPod(notExpired),
+			Status:   crashing(time.Now().Add(-10 * time.Minute)),
+			Expected: "failed: CrashLoopBackOff for more than 5m0s",
+		},
+		{
+			Name: "Unschedulable idle pool pod",
+			Pod:  trashdb.NewPod(trashdb.WithLabels(map[string]string{"app.trashdb/pool": "idle"})),
+			Status: v1.PodStatus{
+				Phase: v1.PodPending,
+				Conditions: []v1.PodCondition{{
+					Type:               v1.PodScheduled,
+					Status:             v1.ConditionFalse,
+					Reason:             v1.PodReasonUnschedulable,
+					LastTransitionTime: metav1.NewTime(time.Now().Add(-1 * time.Hour)),
+				}},
+			},
+			Expected: "failed: Unschedulable for more than 5m0s",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.Pod.Status = tc.Status
+			actual := trashdb.ReapReason(*tc.Pod)
+			if actual != tc.Expected {
+				t.Errorf("Expected %q, got %q", tc.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestExtendPod(t *testing.T) {
+	created := time.Now().Add(-20 * time.Minute)
+	instance := func() v1.Pod {
+		tierName, tier, _ := trashdb.LookupTier("small")
+		return *trashdb.NewPod(
+			trashdb.WithName("pod-123"),
+			trashdb.WithAnnotations(map[string]string{
+				"app.trashdb/expiration":  created.Add(15 * time.Minute).Format(time.RFC3339),
+				"app.trashdb/created":     created.Format(time.RFC3339),
+				"app.trashdb/secret-hash": passwordHash(exampleSecret),
+			}),
+			trashdb.WithTier(tierName, tier),
+			trashdb.WithDeadline(tier),
+		)
+	}
+
+	type testCase struct {
+		Name               string
+		PodSecret          string
+		Extra              time.Duration
+		NoDeadline         bool
+		PlainSecret        bool
+		NoSecret           bool
+		Unmanaged          bool
+		ExpectedExpiration string
+		ExpectedErr        string
+	}
+	testCases := []testCase{
+		{
+			Name:               "Extend pod",
+			PodSecret:          exampleSecret,
+			Extra:              5 * time.Minute,
+			ExpectedExpiration: created.Add(20 * time.Minute).Format(time.RFC3339),
+		},
+		{
+			Name:               "Extend up to tier lifetime",
+			PodSecret:          exampleSecret,
+			Extra:              15 * time.Minute,
+			ExpectedExpiration: created.Add(30 * time.Minute).Format(time.RFC3339),
+		},
+		{
+			Name:               "Extend pod without deadline",
+			PodSecret:          exampleSecret,
+			Extra:              10 * time.Minute,
+			NoDeadline:         true,
+			ExpectedExpiration: created.Add(25 * time.Minute).Format(time.RFC3339),
+		},
+		{
+			Name:        "Extend past tier lifetime",
+			PodSecret:   exampleSecret,
+			Extra:       20 * time.Minute,
+			ExpectedErr: fmt.Sprintf("instance can live at most 30 minutes, it expires at %s at the latest", created.Add(30*time.Minute).Format(time.RFC3339)),
+		},
+		{
+			Name:        "Wrong secret",
+			PodSecret:   "nope",
+			Extra:       10 * time.Minute,
+			ExpectedErr: "Wrong secret",
+		},
+		{
+			Name:               "Plain text secret",
+			PodSecret:          exampleSecret,
+			Extra:              5 * time.Minute,
+			PlainSecret:        true,
+			ExpectedExpiration: created.Add(20 * time.Minute).Format(time.RFC3339),
+		},
+		{
+			Name:        "Wrong plain text secret",
+			PodSecret:   "nope",
+			Extra:       5 * time.Minute,
+			PlainSecret: true,
+			ExpectedErr: "Wrong secret",
+		},
+		{
+			Name:        "Pod without a secret",
+			PodSecret:   exampleSecret,
+			Extra:       5 * time.Minute,
+			NoSecret:    true,
+			ExpectedErr: "Wrong secret",
+		},
+		{
+			Name:        "Pod not managed by trashdb",
+			PodSecret:   exampleSecret,
+			Extra:       5 * time.Minute,
+			Unmanaged:   true,
+			ExpectedErr: `pods "pod-123" not found`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pod := instance()
+			if tc.NoDeadline {
+				pod.Spec.ActiveDeadlineSeconds = nil
+			}
+			if tc.PlainSecret {
+				delete(pod.Annotations, "app.trashdb/secret-hash")
+				pod.Annotations["app.trashdb/secret"] = exampleSecret
+			}
+			if tc.NoSecret {
+				delete(pod.Annotations, "app.trashdb/secret-hash")
+			}
+			if tc.Unmanaged {
+				delete(pod.Labels, "app.kubernetes.io/managed-by")
+			}
+			cluster := &fakeCluster{pods: []v1.Pod{pod}}
+			got, err := trashdb.ExtendPod(context.Background(), cluster.client(), "namespace-123", "pod-123", tc.PodSecret, tc.Extra)
+
+			if tc.ExpectedErr != "" {
+				if err == nil || err.Error() != tc.ExpectedErr {
+					t.Errorf("Expected error %q, got %v", tc.ExpectedErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if actual := got.Annotations["app.trashdb/expiration"]; actual != tc.ExpectedExpiration {
+				t.Errorf("Expected expiration %s, got %s", tc.ExpectedExpiration, actual)
+			}
+			// the deadline is the tier's lifetime plus the grace period, extends don't move it
+			if deadline := got.Spec.ActiveDeadlineSeconds; deadline == nil || *deadline != int64((35*time.Minute).Seconds()) {
+				t.Errorf("Expected a deadline of 35 minutes, got %v", deadline)
+			}
+		})
+	}
+}
+
+func TestDeletePodWithSecret(t *testing.T) {
+	type testCase struct {
+		Name          string
+		NoSecret      bool
+		Unmanaged     bool
+		ExpectDeleted bool
+		ExpectedErr   string
+	}
+	testCases := []testCase{
+		{
+			Name:          "Delete pod",
+			ExpectDeleted: true,
+		},
+		{
+			Name:        "Pod without a secret",
+			NoSecret:    true,
+			ExpectedErr: "Wrong secret",
+		},
+		{
+			Name:        "Pod not managed by trashdb",
+			Unmanaged:   true,
+			ExpectedErr: `pods "pod-123" not found`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pod := trashdb.NewPod(
+				trashdb.WithName("pod-123"),
+				trashdb.WithAnnotations(map[string]string{
+					"app.trashdb/expiration":  time.Now().Add(10 * time.Minute).Format(time.RFC3339),
+					"app.trashdb/secret-hash": passwordHash(exampleSecret),
+				}),
+			)
+			if tc.NoSecret {
+				delete(pod.Annotations, "app.trashdb/secret-hash")
+			}
+			if tc.Unmanaged {
+				delete(pod.Labels, "app.kubernetes.io/managed-by")
+			}
+			cluster := &fakeCluster{pods: []v1.Pod{*pod}}
+			err := trashdb.DeletePodWithSecret(context.Background(), cluster.client(), "namespace-123", "pod-123", exampleSecret)
+
+			if tc.ExpectedErr != "" {
+				if err == nil || err.Error() != tc.ExpectedErr {
+					t.Errorf("Expected error %q, got %v", tc.ExpectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if deleted := len(cluster.pods) == 0; deleted != tc.ExpectDeleted {
+				t.Errorf("Expected deleted to be %v, got %v", tc.ExpectDeleted, deleted)
+			}
+		})
+	}
+}
+
+func TestReconcileHashesSecrets(t *testing.T) {
+	tierName, tier, _ := trashdb.LookupTier("small")
+	cluster := &fakeCluster{pods: []v1.Pod{*trashdb.NewPod(
+		trashdb.WithName("pod-123"),
+		trashdb.WithAnnotations(map[string]string{
+			"app.trashdb/expiration": time.Now().Add(10 * time.Minute).Format(time.RFC3339),
+			"app.trashdb/secret":     exampleSecret,
+		}),
+		trashdb.WithTier(tierName, tier),
+	)}}
+	if err := trashdb.Reconcile(context.Background(), cluster.client(), "namespace-123"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pod := cluster.pods[0]
+	if secret, ok := pod.Annotations["app.trashdb/secret"]; ok {
+		t.Errorf("Expected the plain text secret to be removed, got %q", secret)
+	}
+	if hash := pod.Annotations["app.trashdb/secret-hash"]; hash != passwordHash(exampleSecret) {
+		t.Errorf("Expected the secret hash, got %q", hash)
+	}
+	if pod.Spec.ActiveDeadlineSeconds == nil {
+		t.Errorf("Expected a deadline to be set")
+	}
+}
+
+func TestPodSecurity(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.RuntimeClassName = "gvisor"
+	config.Pool = []trashdb.PoolConfig{{Tier: "small", Size: 1}}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	if _, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	(&trashdb.Pool{}).Refill(context.Background(), client, "namespace-123")
+
+	if len(cluster.pods) != 2 {
+		t.Fatalf("Expected an instance and a pool pod, got %d pods", len(cluster.pods))
+	}
+	for _, pod := range cluster.pods {
+		spec := pod.Spec
+		if spec.RuntimeClassName == nil || *spec.RuntimeClassName != "gvisor" {
+			t.Errorf("%s: expected the gvisor runtime class, got %v", pod.Name, spec.RuntimeClassName)
+		}
+		if spec.AutomountServiceAccountToken == nil || *spec.AutomountServiceAccountToken {
+			t.Errorf("%s: expected no service account token", pod.Name)
+		}
+		if sc := spec.SecurityContext; sc == nil || sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot || sc.RunAsUser == nil || *sc.RunAsUser == 0 ||
+			sc.SeccompProfile == nil || sc.SeccompProfile.Type != v1.SeccompProfileTypeRuntimeDefault {
+			t.Errorf("%s: expected a non-root UID and the RuntimeDefault seccomp profile, got %+v", pod.Name, sc)
+		}
+		for _, c := range spec.Containers {
+			sc := c.SecurityContext
+			if sc == nil || sc.ReadOnlyRootFilesystem == nil || !*sc.ReadOnlyRootFilesystem || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+				t.Errorf("%s/%s: expected a read-only root filesystem and no privilege escalation, got %+v", pod.Name, c.Name, sc)
+			}
+			if sc == nil || sc.Capabilities == nil || !cmp.Equal([]v1.Capability{"ALL"}, sc.Capabilities.Drop) {
+				t.Errorf("%s/%s: expected all capabilities dropped", pod.Name, c.Name)
+			}
+			var writable []string
+			for _, mount := range c.VolumeMounts {
+				if !mount.ReadOnly {
+					writable = append(writable, mount.MountPath)
+				}
+			}
+			if !cmp.Equal([]string{"/data"}, writable) {
+				t.Errorf("%s/%s: expected /data to be the only writable mount, got %v", pod.Name, c.Name, c.VolumeMounts)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package trashdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// What to do with a managed pod that has no usable app.trashdb/expiration annotation,
+// e.g. one a teammate labelled by hand
+const (
+	PolicyDelete     = "delete"
+	PolicyQuarantine = "quarantine"
+	PolicyAdopt      = "adopt"
+)
+
+var expirationPolicyTotal = newCounterVec("trashdb_expiration_policy_total",
+	"Pods without a valid expiration handled by the expiration policy.", "action", "problem", "result")
+
+// expirationProblem returns "missing" or "malformed" for pods the expiration policy applies to, or ""
+func expirationProblem(pod v1.Pod) string {
+	if isIdlePoolPod(pod) {
+		return ""
+	}
+	expiration, ok := pod.Annotations["app.trashdb/expiration"]
+	if !ok {
+		return "missing"
+	}
+	if _, err := time.Parse(time.RFC3339, expiration); err != nil {
+		return "malformed"
+	}
+	return ""
+}
+
+// applyExpirationPolicy handles a pod with a missing or malformed expiration
+func applyExpirationPolicy(ctx context.Context, client KubernetesClient, namespace string, pod v1.Pod, problem string) error {
+	action := config.ExpirationPolicy.Action
+	logger := log.With().Str("podName", instanceName(pod)).Str("action", action).Str("problem", problem).Logger()
+
+	var err error
+	switch action {
+	case PolicyDelete:
+		err = deleteInstanceOrPod(ctx, client, namespace, pod)
+		auditSystem(ctx, ActorExpirationPolicy, AuditDelete, instanceName(pod), result(err), err, map[string]any{"reason": problem + " expiration"})
+		if err == nil {
+			reaped.record(instanceName(pod), problem+" expiration")
+		}
+	case PolicyAdopt:
+		updated := pod.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations["app.trashdb/expiration"] = time.Now().Add(config.ExpirationPolicy.AdoptTTL.Duration).Format(time.RFC3339)
+		if _, err = client.UpdatePod(ctx, namespace, updated); err == nil {
+			recordEvent(ctx, updated, v1.EventTypeNormal, "Adopted",
+				"Expiration was %s, adopted with a TTL of %s", problem, config.ExpirationPolicy.AdoptTTL.Duration)
+		}
+	default:
+		// relabelling takes the pod out of the managed-by=trashdb selector so nothing touches it again
+		updated := pod.DeepCopy()
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Labels["app.kubernetes.io/managed-by"] = "trashdb-quarantine"
+		updated.Labels["app.trashdb/quarantined"] = "true"
+		updated.Annotations["app.trashdb/quarantine-reason"] = problem + " expiration"
+		if _, err = client.UpdatePod(ctx, namespace, updated); err == nil {
+			recordEvent(ctx, updated, v1.EventTypeWarning, "Quarantined",
+				"Expiration was %s, pod is no longer managed by trashdb", problem)
+		}
+	}
+
+	if err != nil {
+		expirationPolicyTotal.WithLabelValues(action, problem, "failure").Inc()
+		logger.Error().Err(err).Msg("Failed to apply expiration policy")
+		return err
+	}
+	expirationPolicyTotal.WithLabelValues(action, problem, "success").Inc()
+	logger.Warn().Msg("Applied expiration policy")
+	return nil
+}
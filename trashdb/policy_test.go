@@ -0,0 +1,126 @@
+package trashdb_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestExpirationPolicy(t *testing.T) {
+	type testCase struct {
+		Name            string
+		Action          string
+		Annotations     map[string]string
+		ExpectDeleted   bool
+		ExpectManagedBy string
+		ExpectEvent     string
+	}
+	testCases := []testCase{
+		{
+			Name:            "Quarantine missing expiration",
+			Action:          trashdb.PolicyQuarantine,
+			ExpectManagedBy: "trashdb-quarantine",
+			ExpectEvent:     "Quarantined",
+		},
+		{
+			Name:          "Delete malformed expiration",
+			Action:        trashdb.PolicyDelete,
+			Annotations:   map[string]string{"app.trashdb/expiration": "tomorrow"},
+			ExpectDeleted: true,
+		},
+		{
+			Name:            "Adopt missing expiration",
+			Action:          trashdb.PolicyAdopt,
+			ExpectManagedBy: "trashdb",
+			ExpectEvent:     "Adopted",
+		},
+		{
+			Name:            "Valid expiration is left alone",
+			Action:          trashdb.PolicyDelete,
+			Annotations:     map[string]string{"app.trashdb/expiration": time.Now().Add(time.Hour).Format(time.RFC3339)},
+			ExpectManagedBy: "trashdb",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			config := trashdb.DefaultConfig()
+			config.ExpirationPolicy.Action = tc.Action
+			trashdb.SetConfig(config)
+			t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+			recorder := withRecorder(t)
+			pod := trashdb.NewPod(
+				trashdb.WithName("hand-made"),
+				trashdb.WithAnnotations(tc.Annotations),
+			)
+			// hand-made pods without an expiration often have no annotations at all
+			if tc.Annotations == nil {
+				pod.Annotations = nil
+			}
+			cluster := &fakeCluster{pods: []v1.Pod{*pod}}
+			if err := trashdb.Reconcile(context.Background(), cluster.client(), "namespace-123"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if tc.ExpectDeleted {
+				if len(cluster.pods) != 0 {
+					t.Errorf("Expected pod to be deleted")
+				}
+				return
+			}
+			if len(cluster.pods) != 1 {
+				t.Fatalf("Expected pod to be kept")
+			}
+
+			pod = &cluster.pods[0]
+			if actual := pod.Labels["app.kubernetes.io/managed-by"]; actual != tc.ExpectManagedBy {
+				t.Errorf("Expected managed-by %q, got %q", tc.ExpectManagedBy, actual)
+			}
+			if tc.ExpectManagedBy == "trashdb" && trashdb.IsExpired(*pod) {
+				t.Errorf("Pod should not be expired")
+			}
+
+			events := drainEvents(recorder)
+			if tc.ExpectEvent != "" && (len(events) != 1 || !strings.Contains(events[0], " "+tc.ExpectEvent+" ")) {
+				t.Errorf("Expected a %s event, got %v", tc.ExpectEvent, events)
+			}
+		})
+	}
+}
+
+func TestReapDryRun(t *testing.T) {
+	cluster := &fakeCluster{pods: []v1.Pod{
+		*trashdb.NewPod(
+			trashdb.WithName("expired"),
+			trashdb.WithAnnotations(map[string]string{
+				"app.trashdb/expiration": time.Now().Add(-1 * time.Minute).Format(time.RFC3339),
+			}),
+		),
+		*trashdb.NewPod(trashdb.WithName("hand-made")),
+		*trashdb.NewPod(
+			trashdb.WithName("healthy"),
+			trashdb.WithAnnotations(map[string]string{
+				"app.trashdb/expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+			}),
+		),
+	}}
+
+	recorder := withRecorder(t)
+	report := trashdb.Reap(context.Background(), cluster.client(), "namespace-123", cluster.pods, true)
+
+	expected := []trashdb.ReapCandidate{
+		{PodName: "expired", Pod: "expired", Action: "delete", Reason: "expired"},
+		{PodName: "hand-made", Pod: "hand-made", Action: "quarantine", Reason: "missing expiration"},
+	}
+	if diff := cmp.Diff(expected, report.Candidates); diff != "" {
+		t.Errorf("Candidates mismatch (-expected +got):\n%s", diff)
+	}
+	if events := drainEvents(recorder); len(cluster.pods) != 3 || len(events) != 0 {
+		t.Errorf("Dry run should not change anything, have %d pods and %d events", len(cluster.pods), len(events))
+	}
+}
@@ -0,0 +1,243 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// Pool keeps idle, ready pods around so creates don't wait for scheduling and image pulls.
+// Idle pods carry app.trashdb/pool=idle and no expiration, claiming one stamps the instance
+// details onto it. Pod names can't change, so the name the user asked for lives in the
+// app.trashdb/name label.
+type Pool struct {
+	mu sync.Mutex
+}
+
+var pool = &Pool{}
+
+func (c *Config) poolSize(engine, tier string) int {
+	for _, p := range c.Pool {
+		if p.Engine == engine && p.Tier == tier {
+			return p.Size
+		}
+	}
+	return 0
+}
+
+func isIdlePoolPod(pod v1.Pod) bool {
+	return pod.Labels["app.trashdb/pool"] == "idle"
+}
+
+func isPodReady(pod v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func idlePoolSelector(engine, tier string) string {
+	return fmt.Sprintf("%s,app.trashdb/pool=idle,app.kubernetes.io/name=%s,app.trashdb/tier=%s", managedBySelector, engine, tier)
+}
+
+// Claim hands out a ready idle pod for the request, or nil when the pool has none
+func (p *Pool) Claim(ctx context.Context, client KubernetesClient, namespace string, req CreateRequest) (*v1.Pod, error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	tierName, tier, err := LookupTier(req.Tier)
+	if err != nil {
+		return nil, err
+	}
+	if config.poolSize(DefaultEngine, tierName) == 0 {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle, err := client.ListPods(ctx, namespace, metav1.ListOptions{
+		LabelSelector: idlePoolSelector(DefaultEngine, tierName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range idle.Items {
+		if candidate.DeletionTimestamp != nil || !isPodReady(candidate) {
+			continue
+		}
+
+		pod := candidate.DeepCopy()
+		// pool pods are ours, but a hand-edited one may have lost its maps
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Labels["app.trashdb/pool"] = "claimed"
+		pod.Labels["app.trashdb/name"] = req.PodName
+		pod.Labels["app.kubernetes.io/instance"] = "redis-" + req.PodName
+		pod.Annotations["app.trashdb/expiration"] = time.Now().Add(req.Duration).Format(time.RFC3339)
+		pod.Annotations[secretHashAnnotation] = passwordHash(req.PodSecret)
+		pod.Annotations["app.trashdb/client"] = req.ClientID
+		for k, v := range createdAnnotation(time.Now()) {
+			pod.Annotations[k] = v
+		}
+		setDeadline(pod, tier)
+		WithLabels(userLabels(req.Labels))(pod)
+		WithTenant(req.Tenant, req.Subject)(pod)
+		WithOwner(req.Owner)(pod)
+
+		// the update carries the resourceVersion we listed, so a racing claim gets a conflict
+		claimed, err := client.UpdatePod(ctx, namespace, pod)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := setEnginePassword(ctx, client, namespace, claimed, req.PodSecret); err != nil {
+			// the pod is ours now but nobody could log in, it goes and the next one is tried
+			logger(ctx).Error().Err(err).Str("pod", claimed.Name).Msg("Failed to set password on pool pod")
+			client.DeletePod(ctx, namespace, claimed.Name)
+			continue
+		}
+		logger(ctx).Info().Str("pod", claimed.Name).Msg("Claimed pod from pool")
+		return claimed, nil
+	}
+	return nil, nil
+}
+
+// Refill tops up every configured pool to its size
+func (p *Pool) Refill(ctx context.Context, client KubernetesClient, namespace string) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, size := range config.Pool {
+		tierName, tier, err := LookupTier(size.Tier)
+		if err != nil {
+			continue
+		}
+
+		idle, err := client.ListPods(ctx, namespace, metav1.ListOptions{
+			LabelSelector: idlePoolSelector(size.Engine, tierName),
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list pool pods")
+			return
+		}
+
+		var have int
+		for _, pod := range idle.Items {
+			if pod.DeletionTimestamp == nil {
+				have++
+			}
+		}
+
+		for i := have; i < size.Size; i++ {
+			// named here rather than by the API server so the pod label for its policy is known
+			name := "pool-" + tierName + "-" + utilrand.String(5)
+			pod := NewPod(
+				WithName(name),
+				WithLabels(map[string]string{
+					"app.trashdb/pool": "idle",
+				}),
+				WithTier(tierName, tier),
+				WithRuntimeClass(config.RuntimeClassName),
+				WithACL(name),
+				withPodLabel(name))
+			created, err := client.CreatePod(ctx, namespace, pod)
+			if err != nil {
+				log.Error().Err(err).Str("tier", tierName).Msg("Failed to create pool pod")
+				break
+			}
+			// nobody knows the password until the pod is claimed and it is changed to the instance secret
+			if err := ensureACL(ctx, client, namespace, created, tier, generatePassword(30)); err != nil {
+				log.Error().Err(err).Str("pod", name).Msg("Failed to create ACL for pool pod")
+				client.DeletePod(ctx, namespace, name)
+				break
+			}
+			if err := ensureNetworkPolicy(ctx, client, namespace, created); err != nil {
+				log.Error().Err(err).Str("pod", name).Msg("Failed to create network policy for pool pod")
+				client.DeletePod(ctx, namespace, name)
+				break
+			}
+		}
+		if have < size.Size {
+			log.Info().Str("tier", tierName).Msgf("Refilled pool with %d pods", size.Size-have)
+		}
+	}
+}
+
+func RefillPool(ctx context.Context, namespace string) {
+	pool.Refill(ctx, nil, namespace)
+}
+
+// instanceSelector selects the pod of the instance with the given name, which has to be valid
+func instanceSelector(podName string) string {
+	return labels.SelectorFromSet(labels.Set{
+		"app.kubernetes.io/managed-by": "trashdb",
+		"app.trashdb/name":             podName,
+	}).String()
+}
+
+// nameTaken checks the app.trashdb/name label, the API server only stops duplicate pod names
+func nameTaken(ctx context.Context, client KubernetesClient, namespace, podName string) (bool, error) {
+	if err := validatePodName(podName); err != nil {
+		return false, err
+	}
+	pods, err := client.ListPods(ctx, namespace, metav1.ListOptions{
+		LabelSelector: instanceSelector(podName),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(pods.Items) > 0, nil
+}
+
+// findPod looks a pod up by the name the user knows it by, which for pool pods isn't the pod name.
+// Only pods managed by trashdb are found, anything else in the namespace isn't an instance.
+func findPod(ctx context.Context, client KubernetesClient, namespace, podName string) (*v1.Pod, error) {
+	if err := validatePodName(podName); err != nil {
+		return nil, err
+	}
+	pod, err := client.GetPod(ctx, namespace, podName)
+	if err == nil && isManaged(*pod) && !isIdlePoolPod(*pod) {
+		return pod, nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	pods, err := client.ListPods(ctx, namespace, metav1.ListOptions{
+		LabelSelector: instanceSelector(podName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, apierrors.NewNotFound(v1.Resource("pods"), podName)
+	}
+	return &pods.Items[0], nil
+}
+
+func isManaged(pod v1.Pod) bool {
+	return pod.Labels["app.kubernetes.io/managed-by"] == "trashdb"
+}
@@ -0,0 +1,133 @@
+package trashdb_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func withPool(t *testing.T, pool ...trashdb.PoolConfig) {
+	config := trashdb.DefaultConfig()
+	config.Pool = pool
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+}
+
+func poolPod(name string, ready bool) v1.Pod {
+	tierName, tier, _ := trashdb.LookupTier("small")
+	pod := trashdb.NewPod(
+		trashdb.WithName(name),
+		trashdb.WithLabels(map[string]string{"app.trashdb/pool": "idle"}),
+		trashdb.WithTier(tierName, tier),
+	)
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: status}}
+	return *pod
+}
+
+// poolACL is the ACL Secret that Refill creates along with a pool pod
+func poolACL(name string) v1.Secret {
+	return v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-acl"},
+		Data: map[string][]byte{
+			"users.acl":      []byte("user default on " + passwordHash("pool") + " ~* &* +@all\nuser trashdb on " + passwordHash("admin") + " ~* &* +@all\n"),
+			"admin-password": []byte("admin"),
+		},
+	}
+}
+
+func TestPoolClaimAndRefill(t *testing.T) {
+	withPool(t, trashdb.PoolConfig{Tier: "small", Size: 2})
+
+	commands := stubEngine(t, "")
+	cluster := &fakeCluster{
+		pods: []v1.Pod{
+			poolPod("pool-small-starting", false),
+			poolPod("pool-small-ready", true),
+		},
+		secrets: []v1.Secret{poolACL("pool-small-starting"), poolACL("pool-small-ready")},
+	}
+	client := cluster.client()
+	pool := &trashdb.Pool{}
+
+	req := trashdb.CreateRequest{
+		ClientID:  "a",
+		PodName:   "my-redis",
+		PodSecret: exampleSecret,
+		Tier:      "small",
+		Duration:  10 * time.Minute,
+	}
+	pod, err := pool.Claim(context.Background(), client, "namespace-123", req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pod == nil || pod.Name != "pool-small-ready" {
+		t.Fatalf("Expected to claim the ready pod, got %v", pod)
+	}
+	if pod.Labels["app.trashdb/name"] != "my-redis" || pod.Annotations["app.trashdb/secret-hash"] != passwordHash(exampleSecret) {
+		t.Errorf("Claimed pod wasn't stamped: %v %v", pod.Labels, pod.Annotations)
+	}
+	if trashdb.IsExpired(*pod) {
+		t.Errorf("Claimed pod should not be expired")
+	}
+	// the pool pod's random password is replaced with the instance secret
+	if diff := cmp.Diff([]string{"ACL SETUSER default resetpass " + passwordHash(exampleSecret)}, *commands); diff != "" {
+		t.Errorf("Engine commands mismatch (-expected +got):\n%s", diff)
+	}
+	if acl := string(findSecret(cluster, "pool-small-ready-acl").Data["users.acl"]); !strings.Contains(acl, passwordHash(exampleSecret)) {
+		t.Errorf("Expected the ACL file to have the instance secret, got %q", acl)
+	}
+
+	// the instance can be found by the name the user asked for
+	found, err := trashdb.GetPod(context.Background(), client, "namespace-123", "my-redis")
+	if err != nil || found.Name != "pool-small-ready" {
+		t.Errorf("Expected to find claimed pod by name, got %v, %v", found, err)
+	}
+
+	// nothing ready is left, so the next claim falls through to a regular create
+	pod, err = pool.Claim(context.Background(), client, "namespace-123", req)
+	if err != nil || pod != nil {
+		t.Errorf("Expected no pod to claim, got %v, %v", pod, err)
+	}
+
+	pool.Refill(context.Background(), client, "namespace-123")
+	if len(cluster.pods) != 3 {
+		t.Errorf("Expected refill to add 1 pod, have %d pods", len(cluster.pods))
+	}
+}
+
+func TestPoolClaimWithoutAnnotations(t *testing.T) {
+	withPool(t, trashdb.PoolConfig{Tier: "small", Size: 1})
+
+	stubEngine(t, "")
+	bare := poolPod("pool-small-bare", true)
+	bare.Annotations = nil
+	cluster := &fakeCluster{pods: []v1.Pod{bare}, secrets: []v1.Secret{poolACL("pool-small-bare")}}
+	pool := &trashdb.Pool{}
+
+	pod, err := pool.Claim(context.Background(), cluster.client(), "namespace-123", trashdb.CreateRequest{
+		ClientID:  "a",
+		PodName:   "my-redis",
+		PodSecret: exampleSecret,
+		Tier:      "small",
+		Duration:  10 * time.Minute,
+	})
+	if err != nil || pod == nil {
+		t.Fatalf("Expected to claim the pod, got %v, %v", pod, err)
+	}
+	if pod.Annotations["app.trashdb/secret-hash"] != passwordHash(exampleSecret) || pod.Annotations["app.trashdb/client"] != "a" {
+		t.Errorf("Claimed pod wasn't stamped: %v", pod.Annotations)
+	}
+}
@@ -0,0 +1,185 @@
+package trashdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Anonymous creates can be made to cost some CPU on the client: GET /challenge hands out a signed
+// challenge with a difficulty, and the create has to come with a solution. A solution is any
+// string such that SHA-256("<challenge>:<solution>") starts with difficulty zero bits. The
+// difficulty goes up as the cluster fills, so a flood gets slower the worse it gets.
+//
+// Challenges are HMAC-signed so nothing has to be stored until one is used, used ones are
+// remembered until they expire so a solution can't be replayed.
+
+// Challenge is what a client has to solve before an anonymous create
+type Challenge struct {
+	Challenge  string    `json:"challenge"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+const challengeMACSize = 16
+
+var (
+	// challengeKey signs challenges, it only has to live as long as the process
+	challengeKey = func() []byte {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		return key
+	}()
+
+	usedChallenges = struct {
+		mu   sync.Mutex
+		used map[string]time.Time
+	}{used: map[string]time.Time{}}
+)
+
+var proofOfWorkTotal = newCounterVec("trashdb_proof_of_work_total",
+	"Anonymous creates by proof-of-work result: success, missing or invalid.", "result")
+
+// challengeDifficulty is the base difficulty, raised towards the maximum as instances run out
+func challengeDifficulty() int {
+	c := config.ProofOfWork
+	limit := config.Capacity.MaxInstances
+	if limit <= 0 || c.MaxDifficulty <= c.Difficulty {
+		return c.Difficulty
+	}
+
+	var used int
+	if pods := instancePods(); pods != nil {
+		used = len(pods.Items)
+	}
+	used += len(waitlist.Queue())
+	load := math.Min(1, float64(used)/float64(limit))
+	return c.Difficulty + int(math.Round(load*float64(c.MaxDifficulty-c.Difficulty)))
+}
+
+// IssueChallenge makes a new challenge at the current difficulty
+func IssueChallenge() Challenge {
+	difficulty := challengeDifficulty()
+	expiresAt := time.Now().Add(config.ProofOfWork.TTL.Duration).Truncate(time.Second)
+
+	// expiry, difficulty and a random nonce, signed
+	payload := make([]byte, 8+1+16)
+	binary.BigEndian.PutUint64(payload, uint64(expiresAt.Unix()))
+	payload[8] = byte(difficulty)
+	if _, err := rand.Read(payload[9:]); err != nil {
+		panic(err)
+	}
+	token := append(payload, challengeMAC(payload)...)
+
+	return Challenge{
+		Challenge:  base64.RawURLEncoding.EncodeToString(token),
+		Difficulty: difficulty,
+		ExpiresAt:  expiresAt,
+	}
+}
+
+func challengeMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write(payload)
+	return mac.Sum(nil)[:challengeMACSize]
+}
+
+// leadingZeroBits counts the zero bits at the start of the hash of challenge and solution
+func leadingZeroBits(challenge, solution string) int {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	var zeros int
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// VerifyProofOfWork checks a solution and uses up the challenge
+func VerifyProofOfWork(challenge, solution string) error {
+	token, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(token) != 8+1+16+challengeMACSize {
+		return fmt.Errorf("invalid challenge")
+	}
+	payload, mac := token[:len(token)-challengeMACSize], token[len(token)-challengeMACSize:]
+	if !hmac.Equal(mac, challengeMAC(payload)) {
+		return fmt.Errorf("invalid challenge")
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	now := time.Now()
+	if now.After(expiresAt) {
+		return fmt.Errorf("challenge has expired, get a new one")
+	}
+	if leadingZeroBits(challenge, solution) < int(payload[8]) {
+		return fmt.Errorf("wrong solution to the challenge")
+	}
+
+	usedChallenges.mu.Lock()
+	defer usedChallenges.mu.Unlock()
+	for used, expiry := range usedChallenges.used {
+		if now.After(expiry) {
+			delete(usedChallenges.used, used)
+		}
+	}
+	if _, ok := usedChallenges.used[challenge]; ok {
+		return fmt.Errorf("challenge was already used, get a new one")
+	}
+	usedChallenges.used[challenge] = expiresAt
+	return nil
+}
+
+// SolveChallenge finds a solution by brute force, for Go clients of the API
+func SolveChallenge(c Challenge) string {
+	for i := uint64(0); ; i++ {
+		solution := strconv.FormatUint(i, 36)
+		if leadingZeroBits(c.Challenge, solution) >= c.Difficulty {
+			return solution
+		}
+	}
+}
+
+// checkProofOfWork makes anonymous creates solve a challenge when that is turned on. Callers with
+// an API key or token don't have to.
+func checkProofOfWork(r *http.Request, challenge, solution string) error {
+	if !config.ProofOfWork.Enabled || requestMetaFrom(r.Context()).Tenant != "" {
+		return nil
+	}
+	if challenge == "" {
+		proofOfWorkTotal.WithLabelValues("missing").Inc()
+		return fmt.Errorf("proof of work required, solve a challenge from /challenge")
+	}
+	if err := VerifyProofOfWork(challenge, solution); err != nil {
+		proofOfWorkTotal.WithLabelValues("invalid").Inc()
+		return err
+	}
+	proofOfWorkTotal.WithLabelValues("success").Inc()
+	return nil
+}
+
+func challengeRequest(w http.ResponseWriter, r *http.Request) {
+	if !config.ProofOfWork.Enabled {
+		sendResponse(w, http.StatusOK, "No challenge needed", map[string]any{"required": false})
+		return
+	}
+	challenge := IssueChallenge()
+	sendResponse(w, http.StatusOK, "Got challenge", map[string]any{
+		"required":   true,
+		"challenge":  challenge.Challenge,
+		"difficulty": challenge.Difficulty,
+		"expiresAt":  challenge.ExpiresAt,
+	})
+}
@@ -0,0 +1,58 @@
+package trashdb_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"testing"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+)
+
+func TestProofOfWork(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.ProofOfWork.Enabled = true
+	config.ProofOfWork.Difficulty = 8
+	config.ProofOfWork.MaxDifficulty = 8
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	challenge := trashdb.IssueChallenge()
+	if challenge.Difficulty != 8 {
+		t.Fatalf("Expected difficulty 8, got %d", challenge.Difficulty)
+	}
+	solution := trashdb.SolveChallenge(challenge)
+
+	// anything hashing to a non-zero first byte falls short of 8 bits
+	var wrong string
+	for i := 0; ; i++ {
+		wrong = strconv.Itoa(i)
+		if sum := sha256.Sum256([]byte(challenge.Challenge + ":" + wrong)); sum[0] != 0 {
+			break
+		}
+	}
+	if err := trashdb.VerifyProofOfWork(challenge.Challenge, wrong); err == nil {
+		t.Errorf("Expected %q not to solve the challenge", wrong)
+	}
+
+	if err := trashdb.VerifyProofOfWork(challenge.Challenge, solution); err != nil {
+		t.Fatalf("Unexpected error verifying solution: %v", err)
+	}
+	if err := trashdb.VerifyProofOfWork(challenge.Challenge, solution); err == nil {
+		t.Errorf("Expected a used challenge to be rejected")
+	}
+
+	// lowering the difficulty in the challenge breaks its signature
+	token, err := base64.RawURLEncoding.DecodeString(trashdb.IssueChallenge().Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token[8] = 1
+	tampered := trashdb.Challenge{Challenge: base64.RawURLEncoding.EncodeToString(token), Difficulty: 1}
+	if err := trashdb.VerifyProofOfWork(tampered.Challenge, trashdb.SolveChallenge(tampered)); err == nil {
+		t.Errorf("Expected a tampered challenge to be rejected")
+	}
+	if err := trashdb.VerifyProofOfWork("garbage", "0"); err == nil {
+		t.Errorf("Expected garbage to be rejected")
+	}
+}
@@ -0,0 +1,153 @@
+package trashdb
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limits are token buckets per route, one per client IP and one per API key or token
+// subject, so a script can't hammer the Kubernetes API through TrashDB or guess pod names with
+// /delete_pod. A request has to get past both.
+
+// RateLimiter hands out tokens from named buckets
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled completely, after that it can be dropped
+	full time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*bucket{}}
+}
+
+var limiter = NewRateLimiter()
+
+var rateLimitedTotal = newCounterVec("trashdb_rate_limited_total",
+	"Requests rejected by rate limits, by route and scope (ip or key).", "route", "scope")
+
+// Take removes a token from the named bucket. If there is none it returns false and how long until
+// there will be one.
+func (l *RateLimiter) Take(name string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	if limit.PerMinute <= 0 {
+		return true, 0
+	}
+	perSecond := limit.PerMinute / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[name] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / perSecond * float64(time.Second)))
+	return true, 0
+}
+
+// sweep drops buckets that have refilled, they are the same as a new one. Callers hold the lock.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for name, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// rateLimited applies the route's limits from the config. It runs inside authenticated so it
+// knows the caller's key.
+func rateLimited(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := config.RateLimit.Routes[route]
+		meta := requestMetaFrom(r.Context())
+		now := time.Now()
+
+		type check struct {
+			scope string
+			name  string
+			limit RateLimit
+		}
+		checks := []check{{scope: "ip", name: meta.ClientIP, limit: limits.PerIP}}
+		if caller := callerKey(meta); caller != "" {
+			checks = append(checks, check{scope: "key", name: caller, limit: limits.PerKey})
+		}
+
+		for _, check := range checks {
+			ok, wait := limiter.Take(route+" "+check.scope+" "+check.name, check.limit, now)
+			if ok {
+				continue
+			}
+			rateLimitedTotal.WithLabelValues(route, check.scope).Inc()
+			logger(r.Context()).Warn().Str("scope", check.scope).Msg("Rate limited")
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			sendResponse(w, http.StatusTooManyRequests, fmt.Sprintf("Too many requests, try again in %d seconds", seconds), nil)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// callerKey is what per-key limits count against: the API key, or the tenant and subject of a token
+func callerKey(meta RequestMeta) string {
+	if meta.APIKeyID != "" {
+		return "key/" + meta.APIKeyID
+	}
+	if meta.Tenant != "" {
+		return "token/" + meta.Tenant + "/" + meta.Subject
+	}
+	return ""
+}
+
+// isTrustedProxy reports whether addr is one of the proxies whose X-Forwarded-For is believed
+func isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, proxy := range config.RateLimit.TrustedProxies {
+		if prefix, err := parseProxy(proxy); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxy accepts a CIDR or a single address
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(proxy); err == nil {
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", proxy)
+	}
+	return netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), nil
+}
@@ -0,0 +1,85 @@
+package trashdb_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := trashdb.NewRateLimiter()
+	limit := trashdb.RateLimit{PerMinute: 6, Burst: 2}
+	start := time.Now()
+
+	type take struct {
+		after        time.Duration
+		expectOK     bool
+		expectWaitAt time.Duration
+	}
+	takes := []take{
+		{after: 0, expectOK: true},
+		{after: 0, expectOK: true},
+		// one token every 10 seconds
+		{after: 0, expectOK: false, expectWaitAt: 10 * time.Second},
+		{after: 4 * time.Second, expectOK: false, expectWaitAt: 6 * time.Second},
+		{after: 10 * time.Second, expectOK: true},
+		{after: 10 * time.Second, expectOK: false, expectWaitAt: 10 * time.Second},
+		// the bucket doesn't fill past its burst
+		{after: 10 * time.Minute, expectOK: true},
+		{after: 10 * time.Minute, expectOK: true},
+		{after: 10 * time.Minute, expectOK: false, expectWaitAt: 10 * time.Second},
+	}
+	for i, tc := range takes {
+		ok, wait := limiter.Take("client", limit, start.Add(tc.after))
+		if ok != tc.expectOK {
+			t.Fatalf("Take %d: expected ok=%v, got %v", i, tc.expectOK, ok)
+		}
+		if !ok && (wait-tc.expectWaitAt).Abs() > time.Millisecond {
+			t.Errorf("Take %d: expected to wait %s, got %s", i, tc.expectWaitAt, wait)
+		}
+	}
+
+	if ok, _ := limiter.Take("someone-else", limit, start); !ok {
+		t.Errorf("Expected buckets to be separate")
+	}
+	if ok, _ := limiter.Take("client", trashdb.RateLimit{}, start); !ok {
+		t.Errorf("Expected a zero rate to be unlimited")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.RateLimit.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	testCases := []struct {
+		Name          string
+		RemoteAddr    string
+		XForwardedFor []string
+		Expected      string
+	}{
+		{Name: "direct", RemoteAddr: "203.0.113.7:1234", Expected: "203.0.113.7"},
+		{Name: "forwarded by an untrusted client", RemoteAddr: "203.0.113.7:1234", XForwardedFor: []string{"1.2.3.4"}, Expected: "203.0.113.7"},
+		{Name: "forwarded by a trusted proxy", RemoteAddr: "10.1.2.3:1234", XForwardedFor: []string{"198.51.100.1"}, Expected: "198.51.100.1"},
+		{Name: "spoofed hops before the client are ignored", RemoteAddr: "10.1.2.3:1234", XForwardedFor: []string{"1.2.3.4, 198.51.100.1"}, Expected: "198.51.100.1"},
+		{Name: "chain of trusted proxies", RemoteAddr: "10.1.2.3:1234", XForwardedFor: []string{"198.51.100.1, 192.168.1.1", "10.9.9.9"}, Expected: "198.51.100.1"},
+		{Name: "garbage hop", RemoteAddr: "10.1.2.3:1234", XForwardedFor: []string{"not-an-ip"}, Expected: "10.1.2.3"},
+		{Name: "trusted proxy without header", RemoteAddr: "192.168.1.1:1234", Expected: "192.168.1.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/create_pod", nil)
+			r.RemoteAddr = tc.RemoteAddr
+			for _, value := range tc.XForwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := trashdb.ClientIP(r); got != tc.Expected {
+				t.Errorf("Expected %s, got %s", tc.Expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package trashdb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ReapCandidate is a pod the reaper acted on, or would have in a dry run
+type ReapCandidate struct {
+	PodName string `json:"podName"`
+	Pod     string `json:"pod"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReapReport is the outcome of one reaper pass
+type ReapReport struct {
+	DryRun     bool            `json:"dryRun"`
+	RanAt      time.Time       `json:"ranAt"`
+	Candidates []ReapCandidate `json:"candidates"`
+	Success    int             `json:"success"`
+	Failures   int             `json:"failures"`
+}
+
+var lastReapReport atomic.Pointer[ReapReport]
+
+var (
+	reaperRunsTotal    = newCounterVec("trashdb_reaper_runs_total", "Reaper passes.", "dry_run")
+	reaperActionsTotal = newCounterVec("trashdb_reaper_actions_total",
+		"Pods the reaper acted on by action (delete, quarantine or adopt) and result.", "action", "result")
+	reaperLastRun = newGauge("trashdb_reaper_last_run_timestamp_seconds", "When the reaper last ran.")
+	_             = newGaugeFunc("trashdb_reaper_backlog", "Pods in the cache the reaper should already have deleted.", reaperBacklog)
+)
+
+// reaperBacklog counts pods that are due for deletion, if it keeps growing the reaper has fallen behind
+func reaperBacklog() map[string]float64 {
+	var due float64
+	if podsCache != nil {
+		for _, pod := range podsCache.Items {
+			if pod.DeletionTimestamp == nil && ReapReason(pod) != "" {
+				due++
+			}
+		}
+	}
+	return map[string]float64{labelKey(): due}
+}
+
+// Reap deletes expired and failed pods and applies the expiration policy to pods without a valid
+// expiration. With dryRun set nothing is changed, the report says what would have happened.
+func Reap(ctx context.Context, client KubernetesClient, namespace string, pods []v1.Pod, dryRun bool) ReapReport {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	report := ReapReport{DryRun: dryRun, RanAt: time.Now(), Candidates: []ReapCandidate{}}
+	for _, pod := range pods {
+		// already on its way out, deleting it again would count and audit it twice
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		candidate := ReapCandidate{PodName: instanceName(pod), Pod: pod.Name, Action: PolicyDelete}
+
+		problem := expirationProblem(pod)
+		if problem != "" {
+			candidate.Action = config.ExpirationPolicy.Action
+			candidate.Reason = problem + " expiration"
+		} else if candidate.Reason = ReapReason(pod); candidate.Reason == "" {
+			continue
+		}
+
+		if dryRun {
+			log.Info().Str("podName", candidate.PodName).Str("action", candidate.Action).Str("reason", candidate.Reason).Msg("Dry run, would reap pod")
+			report.Candidates = append(report.Candidates, candidate)
+			continue
+		}
+
+		var err error
+		if problem != "" {
+			err = applyExpirationPolicy(ctx, client, namespace, pod, problem)
+		} else if err = deleteInstanceOrPod(ctx, client, namespace, pod); err != nil {
+			auditSystem(ctx, ActorReaper, AuditDelete, candidate.PodName, result(err), err, map[string]any{"reason": candidate.Reason})
+			log.Error().Err(err).Str("podName", candidate.PodName).Msg("Failed to delete pod")
+			deletesTotal.WithLabelValues(deleteReason(candidate.Reason), "failure").Inc()
+		} else {
+			deletesTotal.WithLabelValues(deleteReason(candidate.Reason), "success").Inc()
+			auditSystem(ctx, ActorReaper, AuditDelete, candidate.PodName, "success", nil, map[string]any{"reason": candidate.Reason})
+			log.Info().Str("podName", candidate.PodName).Str("reason", candidate.Reason).Msg("Deleted pod")
+			reaped.record(candidate.PodName, candidate.Reason)
+			if candidate.Reason == "expired" {
+				recordEvent(ctx, &pod, v1.EventTypeNormal, EventExpired, "Instance %s expired and was deleted", candidate.PodName)
+			} else {
+				recordEvent(ctx, &pod, v1.EventTypeWarning, EventReaped, "Instance %s deleted, %s", candidate.PodName, candidate.Reason)
+			}
+		}
+
+		if err != nil {
+			candidate.Error = err.Error()
+			report.Failures++
+			reaperActionsTotal.WithLabelValues(candidate.Action, "failure").Inc()
+		} else {
+			report.Success++
+			reaperActionsTotal.WithLabelValues(candidate.Action, "success").Inc()
+		}
+		report.Candidates = append(report.Candidates, candidate)
+	}
+	reaperRunsTotal.WithLabelValues(strconv.FormatBool(dryRun)).Inc()
+	reaperLastRun.SetToCurrentTime()
+
+	total := report.Success + report.Failures
+	if dryRun && len(report.Candidates) > 0 {
+		log.Info().Msgf("Dry run, would clean up %d pods", len(report.Candidates))
+	} else if total > 0 {
+		log.Info().Msgf("Attempted to clean up %d pods, %d success, %d failures", total, report.Success, report.Failures)
+	}
+	return report
+}
+
+// deleteReason is the reason label of trashdb_deletes_total for a reap reason
+func deleteReason(reason string) string {
+	if reason == "expired" {
+		return "expired"
+	}
+	return "failed"
+}
+
+// ReapOnce runs a single reaper pass against the live pods in a namespace, for the reap command
+func ReapOnce(ctx context.Context, namespace string, dryRun bool) (ReapReport, error) {
+	client := &RealKubernetesClient{}
+	pods, err := ListPods(ctx, client, namespace)
+	if err != nil {
+		return ReapReport{}, err
+	}
+	return Reap(ctx, client, namespace, pods.Items, dryRun), nil
+}
+
+func reaperRequest(w http.ResponseWriter, r *http.Request) {
+	report := lastReapReport.Load()
+	if report == nil {
+		sendResponse(w, http.StatusNotFound, "Reaper hasn't run yet", nil)
+		return
+	}
+	sendResponse(w, http.StatusOK, "Got reaper report", map[string]any{"report": report})
+}
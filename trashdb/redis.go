@@ -0,0 +1,82 @@
+package trashdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const redisPort = 6379
+
+// redisCommand sends a single command to a Redis instance and returns the first line of the reply.
+// It only speaks enough RESP for health checks and admin commands, not for reading data back.
+// A nil tlsConfig connects in plaintext, an empty password skips AUTH.
+func redisCommand(ctx context.Context, addr, user, password string, tlsConfig *tls.Config, args ...string) (string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	// the deadline covers the TLS handshake as well
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	reader := bufio.NewReader(conn)
+	if password != "" {
+		if _, err := roundTrip(conn, reader, "AUTH", user, password); err != nil {
+			return "", err
+		}
+	}
+	return roundTrip(conn, reader, args...)
+}
+
+func roundTrip(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("redis: %s", line[1:])
+	}
+	return line, nil
+}
+
+// pingRedis checks that the engine inside the pod is answering
+func pingRedis(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod) error {
+	reply, err := engineCommand(ctx, client, namespace, pod, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "+PONG" {
+		return fmt.Errorf("unexpected reply to PING: %s", reply)
+	}
+	return nil
+}
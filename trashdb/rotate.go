@@ -0,0 +1,114 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// A leaked instance secret can be swapped for a new one without losing the data. The new secret
+// is the engine password from then on, clients still logged in with the old one are disconnected
+// and it is the secret for deletes and extends too. It is handed out once, like on create.
+
+var secretRotationsTotal = newCounterVec("trashdb_secret_rotations_total",
+	"Instance secret rotations by result.", "result")
+
+// RotateSecret gives the instance a new secret, checking the current one first, and returns it
+func RotateSecret(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string) (string, error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	newSecret, err := rotateSecret(ctx, client, namespace, podName, podSecret)
+	secretRotationsTotal.WithLabelValues(result(err)).Inc()
+	audit(ctx, AuditRotate, podName, result(err), err, nil)
+	return newSecret, err
+}
+
+func rotateSecret(ctx context.Context, client KubernetesClient, namespace, podName, podSecret string) (string, error) {
+	pod, err := findOwnPod(ctx, client, namespace, podName)
+	if err != nil {
+		if config.Controller.Enabled && apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("instance %s has no pod yet, try again once it is running", podName)
+		}
+		return "", err
+	}
+	if matches, ok := secretMatches(*pod, podSecret); !ok || !matches {
+		return "", fmt.Errorf("Wrong secret")
+	}
+
+	newSecret := generatePassword(30)
+	// the pod update carries the resourceVersion we read the old secret from, so of two racing
+	// rotations only one gets past here and changes the engine password
+	claimed := pod.DeepCopy()
+	delete(claimed.Annotations, legacySecretAnnotation)
+	claimed.Annotations[secretHashAnnotation] = passwordHash(newSecret)
+	updated, err := client.UpdatePod(ctx, namespace, claimed)
+	if apierrors.IsConflict(err) {
+		return "", fmt.Errorf("instance %s changed while rotating its secret, try again", podName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := setEnginePassword(ctx, client, namespace, updated, newSecret); err != nil {
+		restorePodSecret(ctx, client, namespace, pod)
+		return "", fmt.Errorf("failed to change the engine password: %w", err)
+	}
+	if err := storeCredentials(ctx, client, namespace, updated, newSecret); err != nil {
+		// the old secret goes back everywhere
+		if err := setEnginePassword(ctx, client, namespace, updated, podSecret); err != nil {
+			logger(ctx).Error().Err(err).Msg("Failed to restore engine password")
+		}
+		if err := storeCredentials(ctx, client, namespace, updated, podSecret); err != nil {
+			logger(ctx).Error().Err(err).Msg("Failed to restore instance credentials")
+		}
+		restorePodSecret(ctx, client, namespace, pod)
+		return "", fmt.Errorf("failed to update credentials: %w", err)
+	}
+
+	// changing the password doesn't log out connections that used the old one
+	if _, err := engineCommand(ctx, client, namespace, updated, "CLIENT", "KILL", "USER", "default"); err != nil {
+		logger(ctx).Warn().Err(err).Msg("Failed to disconnect clients using the old secret")
+	}
+	logger(ctx).Info().Msg("Rotated secret")
+	recordEvent(ctx, updated, v1.EventTypeNormal, EventSecretRotated, "Secret of instance %s rotated by its owner", podName)
+	return newSecret, nil
+}
+
+// restorePodSecret puts the secret annotations of original back on the pod after a failed rotation
+func restorePodSecret(ctx context.Context, client KubernetesClient, namespace string, original *v1.Pod) {
+	pod, err := client.GetPod(ctx, namespace, original.Name)
+	if err == nil {
+		pod = pod.DeepCopy()
+		for _, key := range []string{secretHashAnnotation, legacySecretAnnotation} {
+			if value, ok := original.Annotations[key]; ok {
+				pod.Annotations[key] = value
+			} else {
+				delete(pod.Annotations, key)
+			}
+		}
+		_, err = client.UpdatePod(ctx, namespace, pod)
+	}
+	if err != nil {
+		logger(ctx).Error().Err(err).Msg("Failed to restore pod secret")
+	}
+}
+
+// storeCredentials updates the credentials Secret of instances made by the controller, it
+// recreates lost pods with that password
+func storeCredentials(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, secret string) error {
+	if owner := rootOwner(pod); owner.Kind != "TrashInstance" {
+		return nil
+	}
+	credentials, err := client.GetSecret(ctx, namespace, credentialsSecretName(pod.Labels["app.trashdb/name"]))
+	if err != nil {
+		return err
+	}
+	credentials = credentials.DeepCopy()
+	credentials.Data["password"] = []byte(secret)
+	_, err = client.UpdateSecret(ctx, namespace, credentials)
+	return err
+}
@@ -0,0 +1,187 @@
+package trashdb_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubEngine stands in for Redis and records the commands sent to it. Commands starting with
+// fail get an error.
+func stubEngine(t *testing.T, fail string) *[]string {
+	var commands []string
+	trashdb.SetEngineCommand(func(ctx context.Context, client trashdb.KubernetesClient, namespace string, pod *v1.Pod, args ...string) (string, error) {
+		command := strings.Join(args, " ")
+		commands = append(commands, command)
+		if fail != "" && strings.HasPrefix(command, fail) {
+			return "", fmt.Errorf("redis: ERR %s failed", fail)
+		}
+		return "+OK", nil
+	})
+	t.Cleanup(func() { trashdb.SetEngineCommand(nil) })
+	return &commands
+}
+
+func passwordHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return "#" + hex.EncodeToString(sum[:])
+}
+
+func findSecret(cluster *fakeCluster, name string) v1.Secret {
+	i := slices.IndexFunc(cluster.secrets, func(s v1.Secret) bool { return s.Name == name })
+	if i < 0 {
+		return v1.Secret{}
+	}
+	return cluster.secrets[i]
+}
+
+func TestRotateSecret(t *testing.T) {
+	instance := metav1.OwnerReference{APIVersion: "trashdb.io/v1alpha1", Kind: "TrashInstance", Name: "pod-123", UID: "uid-pod-123"}
+
+	testCases := []struct {
+		Name          string
+		PodSecret     string
+		Owner         *metav1.OwnerReference
+		FailCommand   string
+		FailUpdatePod bool
+		ExpectedErr   string
+	}{
+		{Name: "rotated", PodSecret: exampleSecret},
+		{Name: "rotated controller instance", PodSecret: exampleSecret, Owner: &instance},
+		{Name: "wrong secret", PodSecret: "not-the-secret", ExpectedErr: "Wrong secret"},
+		{Name: "engine refuses", PodSecret: exampleSecret, FailCommand: "ACL SETUSER", ExpectedErr: "failed to change the engine password"},
+		{Name: "pod update fails", PodSecret: exampleSecret, Owner: &instance, FailUpdatePod: true, ExpectedErr: "conflict"},
+		{Name: "disconnecting clients fails", PodSecret: exampleSecret, FailCommand: "CLIENT KILL"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			commands := stubEngine(t, tc.FailCommand)
+			cluster := &fakeCluster{}
+			client := cluster.client()
+			if _, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute, trashdb.WithOwner(tc.Owner)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			cluster.secrets = append(cluster.secrets, v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-123-credentials"},
+				Data:       map[string][]byte{"password": []byte(exampleSecret)},
+			})
+			if tc.FailUpdatePod {
+				client.UpdatePodFunc = func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+					return nil, fmt.Errorf("conflict")
+				}
+			}
+
+			newSecret, err := trashdb.RotateSecret(context.Background(), client, "namespace-123", "pod-123", tc.PodSecret)
+			if tc.ExpectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.ExpectedErr) {
+					t.Fatalf("Expected error %q, got %v", tc.ExpectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// a failed rotation leaves the old secret working everywhere
+			expected := exampleSecret
+			if err == nil {
+				expected = newSecret
+				if len(newSecret) != 30 || newSecret == exampleSecret {
+					t.Errorf("Expected a new 30 character secret, got %q", newSecret)
+				}
+				if !slices.Contains(*commands, "CLIENT KILL USER default") {
+					t.Errorf("Expected clients using the old secret to be disconnected, got %v", *commands)
+				}
+			}
+			if got := cluster.pods[0].Annotations["app.trashdb/secret-hash"]; got != passwordHash(expected) {
+				t.Errorf("Expected the pod secret hash to be %q, got %q", passwordHash(expected), got)
+			}
+			if acl := string(findSecret(cluster, "pod-123-acl").Data["users.acl"]); !strings.HasPrefix(acl, "user default on "+passwordHash(expected)+" ") {
+				t.Errorf("Expected the ACL file to have the password, got %q", acl)
+			}
+			// the last password the engine took is the one it has
+			var setPassword string
+			for _, command := range *commands {
+				if strings.HasPrefix(command, "ACL SETUSER") && tc.FailCommand != "ACL SETUSER" {
+					setPassword = command
+				}
+			}
+			if setPassword != "" && setPassword != "ACL SETUSER default resetpass "+passwordHash(expected) {
+				t.Errorf("Expected the engine to end up with the password, got %v", *commands)
+			}
+
+			credentials := string(findSecret(cluster, "pod-123-credentials").Data["password"])
+			if tc.Owner != nil && credentials != expected {
+				t.Errorf("Expected the instance credentials to be %q, got %q", expected, credentials)
+			}
+			if tc.Owner == nil && credentials != exampleSecret {
+				t.Errorf("Expected credentials of other instances to be left alone, got %q", credentials)
+			}
+		})
+	}
+}
+
+func TestRotateSecretRace(t *testing.T) {
+	commands := stubEngine(t, "")
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	if _, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cluster.pods[0].ResourceVersion = "1"
+
+	// updates from a stale read conflict like they do on the API server, and the first one lets
+	// another rotation in between the read and the update
+	var raced bool
+	var other string
+	var otherErr error
+	update := client.UpdatePodFunc
+	client.UpdatePodFunc = func(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+		if !raced {
+			raced = true
+			other, otherErr = trashdb.RotateSecret(ctx, client, namespace, pod.Name, exampleSecret)
+		}
+		if pod.ResourceVersion != cluster.pods[0].ResourceVersion {
+			return nil, apierrors.NewConflict(v1.Resource("pods"), pod.Name, fmt.Errorf("stale resourceVersion"))
+		}
+		pod = pod.DeepCopy()
+		version, _ := strconv.Atoi(pod.ResourceVersion)
+		pod.ResourceVersion = strconv.Itoa(version + 1)
+		return update(ctx, namespace, pod)
+	}
+
+	_, err := trashdb.RotateSecret(context.Background(), client, "namespace-123", "pod-123", exampleSecret)
+	if err == nil || !strings.Contains(err.Error(), "try again") {
+		t.Errorf("Expected the losing rotation to be told to try again, got %v", err)
+	}
+	if otherErr != nil {
+		t.Fatalf("Expected the winning rotation to succeed, got %v", otherErr)
+	}
+
+	// only the winner touched the engine, and everything agrees on its secret
+	var setPasswords []string
+	for _, command := range *commands {
+		if strings.HasPrefix(command, "ACL SETUSER") {
+			setPasswords = append(setPasswords, command)
+		}
+	}
+	if diff := cmp.Diff([]string{"ACL SETUSER default resetpass " + passwordHash(other)}, setPasswords); diff != "" {
+		t.Errorf("Engine password changes mismatch (-expected +got):\n%s", diff)
+	}
+	if got := cluster.pods[0].Annotations["app.trashdb/secret-hash"]; got != passwordHash(other) {
+		t.Errorf("Expected the pod secret hash to be the winner's, got %q", got)
+	}
+	if acl := string(findSecret(cluster, "pod-123-acl").Data["users.acl"]); !strings.HasPrefix(acl, "user default on "+passwordHash(other)+" ") {
+		t.Errorf("Expected the ACL file to have the winner's password, got %q", acl)
+	}
+}
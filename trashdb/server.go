@@ -1,10 +1,16 @@
 package trashdb
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/fewable/words"
@@ -16,42 +22,71 @@ import (
 var nameGenerator = words.NewBuilder().WithSeparator("-").AddMediumWord().AddMediumWord()
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow connections from any origin
-		return true
-	},
+	CheckOrigin:  checkOrigin,
+	Subprotocols: []string{websocketProtocol},
 }
 
+const (
+	defaultWaitTimeout = 60 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
 // TODO: this feels like a hack to get these initialized. Should be a better way
 var namespace string
 
 func StartServer(port string, ns string) {
 	namespace = ns
 
-	http.HandleFunc("/create_pod", createPodRequest)
+	handle("/create_pod", authenticated(rateLimited("/create_pod", createPodRequest)))
+
+	handle("/delete_pod", authenticated(rateLimited("/delete_pod", deletePodRequest)))
+
+	handle("/extend_pod", authenticated(rateLimited("/extend_pod", extendPodRequest)))
+
+	handle("/rotate_secret", authenticated(rateLimited("/rotate_secret", rotateSecretRequest)))
+
+	http.HandleFunc("/list_pod", TraceRequest("/list_pod", withRequestContext("/list_pod", authenticated(listPodWebSocket))))
+
+	handle("/pod_status", authenticated(rateLimited("/pod_status", podStatusRequest)))
 
-	http.HandleFunc("/delete_pod", deletePodRequest)
+	handle("/metrics", metricsRequest)
 
-	http.HandleFunc("/list_pod", listPodWebSocket)
+	handle("/reaper", reaperRequest)
+
+	handle("/tiers", tiersRequest)
+
+	handle("/challenge", rateLimited("/challenge", challengeRequest))
+
+	handle("/", dashboardHandler())
 
 	log.Info().Msgf("Starting server on port %s", port)
 	http.ListenAndServe(":"+port, nil)
 }
 
+// handle registers a route with tracing, latency metrics, a request ID and CORS
+func handle(route string, handler http.HandlerFunc) {
+	http.HandleFunc(route, instrument(route, TraceRequest(route, withRequestContext(route, withCORS(handler)))))
+}
+
 func listPodWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to upgrade connection to websocket")
+		logger(r.Context()).Error().Err(err).Msg("Failed to upgrade connection to websocket")
 		return
 	}
 	defer conn.Close()
 
+	websocketClients.Inc()
+	defer websocketClients.Dec()
+
 	for {
 		select {
 		case <-r.Context().Done():
 			return
 		default:
-			sendMessage(conn, "Got pods", map[string]any{"pods": podsCache})
+			// only statuses, raw pods carry more than their owners should see
+			pods := visiblePods(r.Context(), instancePods())
+			sendMessage(conn, "Got pods", map[string]any{"statuses": podStatuses(pods), "queue": visibleQueue(r.Context())})
 
 			time.Sleep(1 * time.Second)
 		}
@@ -71,6 +106,7 @@ func deletePodRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]any{"podName": body.PodName}
+	withPodName(r.Context(), body.PodName)
 
 	err := DeletePodWithSecret(r.Context(), nil, namespace, body.PodName, body.PodSecret)
 	if err != nil {
@@ -81,10 +117,75 @@ func deletePodRequest(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, http.StatusOK, "Pod deleted", data)
 }
 
+func extendPodRequest(w http.ResponseWriter, r *http.Request) {
+	type extendPodRequest struct {
+		PodName   string `json:"podName"`
+		PodSecret string `json:"podSecret"`
+		Duration  int    `json:"duration"`
+	}
+
+	var body extendPodRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendResponse(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	data := map[string]any{"podName": body.PodName}
+	withPodName(r.Context(), body.PodName)
+
+	pod, err := ExtendPod(r.Context(), nil, namespace, body.PodName, body.PodSecret, time.Duration(body.Duration)*time.Minute)
+	if err != nil {
+		sendResponse(w, http.StatusBadRequest, err.Error(), data)
+		return
+	}
+
+	data["app.trashdb/expiration"] = pod.Annotations["app.trashdb/expiration"]
+	sendResponse(w, http.StatusOK, "Pod extended", data)
+}
+
+func rotateSecretRequest(w http.ResponseWriter, r *http.Request) {
+	type rotateSecretRequest struct {
+		PodName   string `json:"podName"`
+		PodSecret string `json:"podSecret"`
+	}
+
+	var body rotateSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendResponse(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	data := map[string]any{"podName": body.PodName}
+	withPodName(r.Context(), body.PodName)
+
+	newSecret, err := RotateSecret(r.Context(), nil, namespace, body.PodName, body.PodSecret)
+	if err != nil {
+		sendResponse(w, http.StatusBadRequest, err.Error(), data)
+		return
+	}
+
+	// this is the only time the new secret is shown
+	data["podSecret"] = newSecret
+	if config.TLS.Enabled {
+		data["host"] = instanceHost(namespace, body.PodName)
+		data["caCert"] = caBundle()
+	}
+	sendResponse(w, http.StatusOK, "Secret rotated", data)
+}
+
 func createPodRequest(w http.ResponseWriter, r *http.Request) {
 	type createPodRequest struct {
 		PodName  string `json:"podName"`
+		Engine   string `json:"engine"`
+		Tier     string `json:"tier"`
 		Duration int    `json:"duration"`
+		Queue    bool   `json:"queue"`
+		// Wait blocks until the instance answers, for up to WaitTimeout seconds
+		Wait        bool `json:"wait"`
+		WaitTimeout int  `json:"waitTimeout"`
+		// Challenge and Solution are the proof of work for anonymous creates, see pow.go
+		Challenge string `json:"challenge"`
+		Solution  string `json:"solution"`
 	}
 
 	var body createPodRequest
@@ -93,6 +194,16 @@ func createPodRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkProofOfWork(r, body.Challenge, body.Solution); err != nil {
+		sendResponse(w, http.StatusPreconditionRequired, err.Error(), nil)
+		return
+	}
+
+	if body.Engine != "" && body.Engine != DefaultEngine {
+		sendResponse(w, http.StatusBadRequest, fmt.Sprintf("unknown engine %q", body.Engine), nil)
+		return
+	}
+
 	podName := body.PodName
 	if podName == "" {
 		podName = nameGenerator.GetString()
@@ -106,17 +217,166 @@ func createPodRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]any{"podName": podName, "podSecret": podSecret}
+	if config.TLS.Enabled {
+		// instances only speak TLS, clients verify them with the CA against the Service name
+		data["host"] = instanceHost(namespace, podName)
+		data["caCert"] = caBundle()
+	}
+	withPodName(r.Context(), podName)
 
-	if pod, err := CreatePod(r.Context(), nil, namespace, podName, podSecret, duration); err != nil {
+	if err := checkAnonymousCreate(r.Context(), body.Tier, duration); err != nil {
+		sendResponse(w, http.StatusForbidden, err.Error(), data)
+		return
+	}
+	meta := requestMetaFrom(r.Context())
+
+	if config.Controller.Enabled {
+		createInstanceRequest(w, r, CreateRequest{
+			ClientID:  clientID(r),
+			Tenant:    meta.Tenant,
+			Subject:   meta.Subject,
+			PodName:   podName,
+			PodSecret: podSecret,
+			Tier:      body.Tier,
+			Duration:  duration,
+		}, body.Wait, body.WaitTimeout, data)
+		return
+	}
+
+	pod, position, err := AdmitPod(r.Context(), nil, namespace, CreateRequest{
+		ClientID:  clientID(r),
+		Tenant:    meta.Tenant,
+		Subject:   meta.Subject,
+		PodName:   podName,
+		PodSecret: podSecret,
+		Tier:      body.Tier,
+		Duration:  duration,
+	}, body.Queue)
+	if err != nil {
+		var capacityErr *CapacityError
+		if errors.As(err, &capacityErr) {
+			sendResponse(w, http.StatusTooManyRequests, err.Error(), nil)
+			return
+		}
 		sendResponse(w, http.StatusBadRequest, err.Error(), data)
 		return
-	} else {
-		data["app.trashdb/expiration"] = pod.Annotations["app.trashdb/expiration"]
+	}
+
+	if pod == nil {
+		data["queuePosition"] = position
+		sendResponse(w, http.StatusAccepted, "Pod queued", data)
+		return
+	}
+
+	data["app.trashdb/expiration"] = pod.Annotations["app.trashdb/expiration"]
+	data["tier"] = pod.Labels["app.trashdb/tier"]
+
+	if body.Wait && !waitForPod(w, r, podName, body.WaitTimeout, data) {
+		return
 	}
 
 	sendResponse(w, http.StatusOK, "Pod created", data)
 }
 
+// createInstanceRequest is the create handler in controller mode, where the controller does the
+// actual work and capacity problems show up in the instance status instead of a 429
+func createInstanceRequest(w http.ResponseWriter, r *http.Request, req CreateRequest, wait bool, waitTimeout int, data map[string]any) {
+	instance, err := CreateInstance(r.Context(), nil, namespace, req)
+	if err != nil {
+		sendResponse(w, http.StatusBadRequest, err.Error(), data)
+		return
+	}
+	data["tier"] = instance.Spec.Tier
+	data["phase"] = InstancePending
+
+	if !wait {
+		sendResponse(w, http.StatusAccepted, "Instance created", data)
+		return
+	}
+	if !waitForPod(w, r, req.PodName, waitTimeout, data) {
+		return
+	}
+	data["phase"] = InstanceRunning
+	sendResponse(w, http.StatusOK, "Instance created", data)
+}
+
+// waitForPod blocks until the pod answers, it sends the error response itself and returns false if it doesn't
+func waitForPod(w http.ResponseWriter, r *http.Request, podName string, waitTimeout int, data map[string]any) bool {
+	timeout := min(time.Duration(waitTimeout)*time.Second, maxWaitTimeout)
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	pod, err := WaitForReady(ctx, nil, namespace, podName)
+	if err != nil {
+		sendResponse(w, http.StatusGatewayTimeout, err.Error(), data)
+		return false
+	}
+	data["app.trashdb/expiration"] = pod.Annotations["app.trashdb/expiration"]
+	data["ready"] = true
+	return true
+}
+
+func podStatusRequest(w http.ResponseWriter, r *http.Request) {
+	podName := r.URL.Query().Get("podName")
+	if podName == "" {
+		sendResponse(w, http.StatusBadRequest, "required: podName", nil)
+		return
+	}
+
+	pod, err := GetPod(r.Context(), nil, namespace, podName)
+	if err != nil {
+		if reason, ok := reaped.reason(podName); ok {
+			sendResponse(w, http.StatusGone, "Pod was deleted", map[string]any{"podName": podName, "reason": reason})
+			return
+		}
+		// a queued create has no pod yet, or never will
+		for _, entry := range visibleQueue(r.Context()) {
+			if entry.PodName != podName {
+				continue
+			}
+			if entry.Error != "" {
+				sendResponse(w, http.StatusGone, "Queued create failed", map[string]any{"podName": podName, "reason": entry.Error})
+			} else {
+				sendResponse(w, http.StatusAccepted, "Pod queued", map[string]any{"podName": podName, "position": entry.Position})
+			}
+			return
+		}
+		sendResponse(w, http.StatusNotFound, err.Error(), map[string]any{"podName": podName})
+		return
+	}
+
+	sendResponse(w, http.StatusOK, "Got pod status", map[string]any{"status": GetPodStatus(*pod)})
+}
+
+// ClientIP identifies the caller for per-client limits. X-Forwarded-For is only believed when
+// the request comes through one of the trusted proxies in the config.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	// walk back from the nearest hop, the first address that isn't a trusted proxy is the client
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
 func generatePassword(length int) string {
 	bytes := make([]byte, length)
 	if _, err := rand.Read(bytes); err != nil {
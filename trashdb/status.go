@@ -0,0 +1,128 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+// PodStatus is the user facing summary of an instance. It is all the dashboard gets, so it never
+// carries anything secret.
+type PodStatus struct {
+	PodName        string      `json:"podName"`
+	Tier           string      `json:"tier,omitempty"`
+	Expiration     string      `json:"expiration,omitempty"`
+	Phase          v1.PodPhase `json:"phase"`
+	Ready          bool        `json:"ready"`
+	ContainerState string      `json:"containerState"`
+	RestartCount   int32       `json:"restartCount"`
+	PodIP          string      `json:"podIP"`
+	TimeLeft       int         `json:"timeLeft"`
+	LastFailure    string      `json:"lastFailure,omitempty"`
+	Failure        string      `json:"failure,omitempty"`
+}
+
+func GetPodStatus(pod v1.Pod) PodStatus {
+	status := PodStatus{
+		PodName: instanceName(pod),
+		Tier:    pod.Labels["app.trashdb/tier"],
+		Phase:   pod.Status.Phase,
+		Ready:   isPodReady(pod),
+		PodIP:   pod.Status.PodIP,
+	}
+
+	if reason, _, ok := PodFailure(pod); ok {
+		status.Failure = reason
+	}
+
+	if expiration, err := PodExpiration(pod); err == nil {
+		status.Expiration = expiration.Format(time.RFC3339)
+		status.TimeLeft = max(0, int(time.Until(*expiration).Seconds()))
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse {
+			status.LastFailure = fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+		}
+	}
+
+	for _, container := range pod.Status.ContainerStatuses {
+		status.RestartCount += container.RestartCount
+
+		switch {
+		case container.State.Running != nil:
+			status.ContainerState = "running"
+		case container.State.Waiting != nil:
+			status.ContainerState = "waiting: " + container.State.Waiting.Reason
+			if container.State.Waiting.Message != "" {
+				status.LastFailure = fmt.Sprintf("%s: %s", container.State.Waiting.Reason, container.State.Waiting.Message)
+			}
+		case container.State.Terminated != nil:
+			status.ContainerState = "terminated: " + container.State.Terminated.Reason
+		}
+
+		if last := container.LastTerminationState.Terminated; last != nil && status.LastFailure == "" {
+			status.LastFailure = fmt.Sprintf("%s (exit code %d)", last.Reason, last.ExitCode)
+		}
+	}
+	return status
+}
+
+func podStatuses(pods *v1.PodList) []PodStatus {
+	if pods == nil {
+		return nil
+	}
+	statuses := make([]PodStatus, len(pods.Items))
+	for i, pod := range pods.Items {
+		statuses[i] = GetPodStatus(pod)
+	}
+	return statuses
+}
+
+// instanceName is the name the user knows the pod by
+func instanceName(pod v1.Pod) string {
+	if name, ok := pod.Labels["app.trashdb/name"]; ok {
+		return name
+	}
+	return pod.Name
+}
+
+// WaitForReady blocks until the pod is Ready and the engine answers, or the context is done
+func WaitForReady(ctx context.Context, client KubernetesClient, namespace, podName string) (_ *v1.Pod, err error) {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	ctx, span := startSpan(ctx, "WaitForReady", trace.SpanKindInternal)
+	span.SetAttributes(attribute.String("trashdb.pod_name", podName))
+	defer finishSpan(span, &err)
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		pod, err := findPod(ctx, client, namespace, podName)
+		switch {
+		case err != nil:
+			lastErr = err
+		case !isPodReady(*pod):
+			lastErr = fmt.Errorf("pod is %s", pod.Status.Phase)
+		default:
+			if lastErr = pingRedis(ctx, client, namespace, pod); lastErr == nil {
+				logger(ctx).Info().Msg("Pod is ready")
+				return pod, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("pod not ready in time: %w", lastErr)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package trashdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetPodStatus(t *testing.T) {
+	expiration := time.Now().Add(10*time.Minute + 30*time.Second).Format(time.RFC3339)
+
+	type testCase struct {
+		Name     string
+		Pod      *v1.Pod
+		Status   v1.PodStatus
+		Expected trashdb.PodStatus
+	}
+	testCases := []testCase{
+		{
+			Name: "Running and ready",
+			Pod: trashdb.NewPod(
+				trashdb.WithName("pool-small-1"),
+				trashdb.WithLabels(map[string]string{"app.trashdb/name": "pod-123", "app.trashdb/tier": "small"}),
+				trashdb.WithAnnotations(map[string]string{
+					"app.trashdb/expiration":  expiration,
+					"app.trashdb/secret-hash": "#0123",
+				}),
+			),
+			Status: v1.PodStatus{
+				Phase:      v1.PodRunning,
+				PodIP:      "10.0.0.12",
+				Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+				ContainerStatuses: []v1.ContainerStatus{{
+					State:        v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+					RestartCount: 1,
+					LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+						Reason:   "OOMKilled",
+						ExitCode: 137,
+					}},
+				}},
+			},
+			Expected: trashdb.PodStatus{
+				PodName:        "pod-123",
+				Tier:           "small",
+				Expiration:     expiration,
+				Phase:          v1.PodRunning,
+				Ready:          true,
+				ContainerState: "running",
+				RestartCount:   1,
+				PodIP:          "10.0.0.12",
+				TimeLeft:       630,
+				LastFailure:    "OOMKilled (exit code 137)",
+			},
+		},
+		{
+			Name: "Image pull failing",
+			Pod:  trashdb.NewPod(trashdb.WithName("pod-123")),
+			Status: v1.PodStatus{
+				Phase: v1.PodPending,
+				ContainerStatuses: []v1.ContainerStatus{{
+					State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{
+						Reason:  "ImagePullBackOff",
+						Message: "Back-off pulling image",
+					}},
+				}},
+			},
+			Expected: trashdb.PodStatus{
+				PodName:        "pod-123",
+				Phase:          v1.PodPending,
+				ContainerState: "waiting: ImagePullBackOff",
+				LastFailure:    "ImagePullBackOff: Back-off pulling image",
+				Failure:        "ImagePullBackOff",
+			},
+		},
+		{
+			Name: "Unschedulable",
+			Pod:  trashdb.NewPod(trashdb.WithName("pod-123")),
+			Status: v1.PodStatus{
+				Phase: v1.PodPending,
+				Conditions: []v1.PodCondition{{
+					Type:    v1.PodScheduled,
+					Status:  v1.ConditionFalse,
+					Reason:  "Unschedulable",
+					Message: "0/3 nodes are available: 3 Insufficient memory.",
+				}},
+			},
+			Expected: trashdb.PodStatus{
+				PodName:     "pod-123",
+				Phase:       v1.PodPending,
+				LastFailure: "Unschedulable: 0/3 nodes are available: 3 Insufficient memory.",
+				Failure:     "Unschedulable",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.Pod.Status = tc.Status
+			got := trashdb.GetPodStatus(*tc.Pod)
+
+			// allow for the clock moving while the test runs
+			if got.TimeLeft > 0 && tc.Expected.TimeLeft-got.TimeLeft <= 2 {
+				got.TimeLeft = tc.Expected.TimeLeft
+			}
+			if diff := cmp.Diff(tc.Expected, got); diff != "" {
+				t.Errorf("Status mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Tier is a named size for an instance
+type Tier struct {
+	Requests    v1.ResourceList `json:"requests"`
+	Limits      v1.ResourceList `json:"limits"`
+	MaxMemory   string          `json:"maxmemory"`
+	MaxDuration metav1.Duration `json:"maxDuration"`
+	// Commands blocks commands for the tier's clients, see acl.go
+	Commands CommandRules `json:"commands"`
+}
+
+func resourceList(cpu, memory string) v1.ResourceList {
+	return v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(cpu),
+		v1.ResourceMemory: resource.MustParse(memory),
+	}
+}
+
+// LookupTier returns the named tier, or the default tier if name is empty
+func LookupTier(name string) (string, Tier, error) {
+	if name == "" {
+		name = config.DefaultTier
+	}
+	tier, ok := config.Tiers[name]
+	if !ok {
+		return "", Tier{}, fmt.Errorf("unknown tier %q", name)
+	}
+	return name, tier, nil
+}
+
+func WithTier(name string, tier Tier) PodOption {
+	return func(p *v1.Pod) {
+		p.Labels["app.trashdb/tier"] = name
+		for i := range p.Spec.Containers {
+			c := &p.Spec.Containers[i]
+			c.Resources.Requests = tier.Requests.DeepCopy()
+			c.Resources.Limits = tier.Limits.DeepCopy()
+			if tier.MaxMemory != "" {
+				c.Args = append(c.Args, "--maxmemory", tier.MaxMemory)
+			}
+		}
+	}
+}
+
+// quotaUsage maps the resource names a ResourceQuota can limit to how much a single pod of the tier uses
+func quotaUsage(tier Tier) v1.ResourceList {
+	usage := v1.ResourceList{
+		v1.ResourcePods: resource.MustParse("1"),
+	}
+	if cpu, ok := tier.Requests[v1.ResourceCPU]; ok {
+		usage[v1.ResourceCPU] = cpu
+		usage[v1.ResourceRequestsCPU] = cpu
+	}
+	if memory, ok := tier.Requests[v1.ResourceMemory]; ok {
+		usage[v1.ResourceMemory] = memory
+		usage[v1.ResourceRequestsMemory] = memory
+	}
+	if cpu, ok := tier.Limits[v1.ResourceCPU]; ok {
+		usage[v1.ResourceLimitsCPU] = cpu
+	}
+	if memory, ok := tier.Limits[v1.ResourceMemory]; ok {
+		usage[v1.ResourceLimitsMemory] = memory
+	}
+	return usage
+}
+
+// CheckQuota makes sure one more pod of the tier fits in every ResourceQuota of the namespace,
+// so an oversized request fails up front instead of leaving a pod stuck in Pending
+func CheckQuota(ctx context.Context, client KubernetesClient, namespace, tierName string, tier Tier) error {
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	quotas, err := client.ListResourceQuotas(ctx, namespace)
+	if err != nil {
+		// not being able to read quotas shouldn't block creates, the API server still enforces them
+		logger(ctx).Warn().Err(err).Msg("Failed to list resource quotas, skipping quota check")
+		return nil
+	}
+
+	usage := quotaUsage(tier)
+	for _, quota := range quotas.Items {
+		for name, hard := range quota.Status.Hard {
+			needed, ok := usage[name]
+			if !ok {
+				continue
+			}
+			if needed.Cmp(hard) > 0 {
+				return fmt.Errorf("tier %q needs %s=%s which exceeds quota %q limit of %s", tierName, name, needed.String(), quota.Name, hard.String())
+			}
+
+			remaining := hard.DeepCopy()
+			if used, ok := quota.Status.Used[name]; ok {
+				remaining.Sub(used)
+			}
+			if needed.Cmp(remaining) > 0 {
+				return fmt.Errorf("tier %q needs %s=%s but quota %q only has %s of %s left", tierName, name, needed.String(), quota.Name, remaining.String(), hard.String())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package trashdb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// In TLS mode Redis only speaks TLS, on the usual port. TrashDB keeps its own CA in a Secret,
+// generated on first start, and gives every instance a certificate for its DNS name that lasts
+// as long as the pod can. The CA certificate is handed out on create so clients can verify it.
+//
+// The CA Secret has no managed-by label, it doesn't belong to an instance and the orphan sweep
+// must leave it alone.
+
+const (
+	caValidity = 5 * 365 * 24 * time.Hour
+	// certBackdate allows for clocks that are a little behind
+	certBackdate = 5 * time.Minute
+	tlsMountPath = "/tls"
+)
+
+type caStore struct {
+	mu   sync.RWMutex
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var certAuthority = &caStore{}
+
+func tlsSecretName(instance string) string {
+	return instance + "-tls"
+}
+
+// instanceHost is the DNS name of the instance's Service
+func instanceHost(namespace, instance string) string {
+	return fmt.Sprintf("%s.%s.svc", instance, namespace)
+}
+
+// LoadCA reads the CA from its Secret, generating it if there is none yet
+func LoadCA(ctx context.Context, client KubernetesClient, namespace string) error {
+	if !config.TLS.Enabled {
+		return nil
+	}
+	if client == nil {
+		client = &RealKubernetesClient{}
+	}
+
+	secret, err := client.GetSecret(ctx, namespace, config.TLS.CASecret)
+	if apierrors.IsNotFound(err) {
+		secret, err = generateCA(namespace)
+		if err != nil {
+			return err
+		}
+		if _, err = client.CreateSecret(ctx, namespace, secret); apierrors.IsAlreadyExists(err) {
+			// another replica got there first
+			secret, err = client.GetSecret(ctx, namespace, config.TLS.CASecret)
+		} else if err == nil {
+			log.Info().Str("secret", secret.Name).Msg("Generated TLS CA")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load TLS CA: %w", err)
+	}
+
+	pair, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !cert.IsCA {
+		return fmt.Errorf("secret %s doesn't hold an ECDSA CA", secret.Name)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("TLS CA in secret %s expired on %s, delete the secret to generate a new one", secret.Name, cert.NotAfter.Format(time.DateOnly))
+	}
+
+	certAuthority.mu.Lock()
+	certAuthority.cert, certAuthority.key, certAuthority.pem = cert, key, secret.Data[v1.TLSCertKey]
+	certAuthority.mu.Unlock()
+	return nil
+}
+
+func generateCA(namespace string) (*v1.Secret, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "TrashDB CA " + namespace},
+		NotBefore:             now.Add(-certBackdate),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certPEM, keyPEM, err := signCertificate(template, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TLS CA: %w", err)
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      config.TLS.CASecret,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/part-of": "trashdb"},
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{v1.TLSCertKey: certPEM, v1.TLSPrivateKeyKey: keyPEM},
+	}, nil
+}
+
+// signCertificate makes a new key and signs a certificate for it, self-signed if parent is nil
+func signCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// caBundle is the PEM CA certificate clients verify instances with
+func caBundle() string {
+	certAuthority.mu.RLock()
+	defer certAuthority.mu.RUnlock()
+	return string(certAuthority.pem)
+}
+
+// tlsSecret issues a certificate for the instance that is valid as long as its pod can live
+func tlsSecret(namespace, instance string, validity time.Duration, owner metav1.OwnerReference) (*v1.Secret, error) {
+	certAuthority.mu.RLock()
+	defer certAuthority.mu.RUnlock()
+	if certAuthority.cert == nil {
+		return nil, fmt.Errorf("TLS CA isn't loaded")
+	}
+
+	host := instanceHost(namespace, instance)
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: host},
+		DNSNames:    []string{host, host + ".cluster.local", instance + "." + namespace, instance},
+		NotBefore:   now.Add(-certBackdate),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certPEM, keyPEM, err := signCertificate(template, certAuthority.cert, certAuthority.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue TLS certificate: %w", err)
+	}
+	return &v1.Secret{
+		ObjectMeta: dependentMeta(namespace, tlsSecretName(instance), instance, owner),
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       certPEM,
+			v1.TLSPrivateKeyKey: keyPEM,
+			"ca.crt":            certAuthority.pem,
+		},
+	}, nil
+}
+
+// withTLS mounts the instance's certificate and has Redis serve TLS only, on the usual port
+func withTLS(instance string) PodOption {
+	return func(p *v1.Pod) {
+		p.Spec.Volumes = append(p.Spec.Volumes, v1.Volume{
+			Name: "tls",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+				SecretName:  tlsSecretName(instance),
+				DefaultMode: ptrTo(int32(0o440)),
+			}},
+		})
+		for i := range p.Spec.Containers {
+			c := &p.Spec.Containers[i]
+			c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{Name: "tls", MountPath: tlsMountPath, ReadOnly: true})
+			c.Args = append(c.Args,
+				"--port", "0",
+				"--tls-port", fmt.Sprint(redisPort),
+				"--tls-cert-file", tlsMountPath+"/"+v1.TLSCertKey,
+				"--tls-key-file", tlsMountPath+"/"+v1.TLSPrivateKeyKey,
+				"--tls-ca-cert-file", tlsMountPath+"/ca.crt",
+				"--tls-auth-clients", "no")
+		}
+	}
+}
+
+// ensureTLS issues the pod's certificate and gives it a Service, so the name on the certificate
+// resolves. Both are owned by the instance.
+func ensureTLS(ctx context.Context, client KubernetesClient, namespace string, pod *v1.Pod, tier Tier) error {
+	if !config.TLS.Enabled {
+		return nil
+	}
+	instance := pod.Labels["app.trashdb/name"]
+	owner := rootOwner(pod)
+
+	secret, err := tlsSecret(namespace, instance, tier.MaxDuration.Duration+deadlineGrace, owner)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CreateSecret(ctx, namespace, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	if _, err := client.CreateService(ctx, namespace, instanceService(namespace, instance, owner)); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// redisTLSConfig is how TrashDB itself connects to an instance, nil when TLS is off
+func redisTLSConfig(pod *v1.Pod) *tls.Config {
+	if !config.TLS.Enabled {
+		return nil
+	}
+	certAuthority.mu.RLock()
+	defer certAuthority.mu.RUnlock()
+	roots := x509.NewCertPool()
+	if certAuthority.cert != nil {
+		roots.AddCert(certAuthority.cert)
+	}
+	return &tls.Config{
+		RootCAs:    roots,
+		ServerName: instanceHost(pod.Namespace, pod.Labels["app.trashdb/name"]),
+		MinVersion: tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,96 @@
+package trashdb_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTLS(t *testing.T) {
+	config := trashdb.DefaultConfig()
+	config.TLS.Enabled = true
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	trashdb.SetConfig(config)
+	t.Cleanup(func() { trashdb.SetConfig(trashdb.DefaultConfig()) })
+
+	cluster := &fakeCluster{}
+	client := cluster.client()
+	for range 2 {
+		if err := trashdb.LoadCA(context.Background(), client, "namespace-123"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(cluster.secrets) != 1 || cluster.secrets[0].Name != "trashdb-ca" {
+		t.Fatalf("Expected the CA to be generated once, got %d secrets", len(cluster.secrets))
+	}
+	if _, ok := cluster.secrets[0].Labels["app.kubernetes.io/managed-by"]; ok {
+		t.Errorf("Expected the CA secret to be left alone by the orphan sweep")
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cluster.secrets[0].Data[v1.TLSCertKey])
+
+	pod, err := trashdb.CreatePod(context.Background(), client, "namespace-123", "pod-123", exampleSecret, "small", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	args := pod.Spec.Containers[0].Args
+	if i := slices.Index(args, "--tls-port"); i < 0 || args[i+1] != "6379" || !slices.Contains(args, "--port") {
+		t.Errorf("Expected Redis to serve TLS only, got args %v", args)
+	}
+	if !slices.ContainsFunc(pod.Spec.Volumes, func(v v1.Volume) bool { return v.Secret != nil && v.Secret.SecretName == "pod-123-tls" }) {
+		t.Errorf("Expected the certificate to be mounted, got volumes %v", pod.Spec.Volumes)
+	}
+	if !slices.ContainsFunc(cluster.dependents["Service"], func(s metav1.ObjectMeta) bool { return s.Name == "pod-123" }) {
+		t.Errorf("Expected a Service for the name on the certificate")
+	}
+
+	i := slices.IndexFunc(cluster.secrets, func(s v1.Secret) bool { return s.Name == "pod-123-tls" })
+	if i < 0 {
+		t.Fatalf("Expected a certificate secret for the instance")
+	}
+	block, _ := pem.Decode(cluster.secrets[i].Data[v1.TLSCertKey])
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Invalid certificate: %v", err)
+	}
+
+	// the small tier lives for up to 30 minutes, plus 5 minutes before the deadline kills it
+	testCases := []struct {
+		Name     string
+		DNSName  string
+		After    time.Duration
+		Expected bool
+	}{
+		{Name: "service name", DNSName: "pod-123.namespace-123.svc", Expected: true},
+		{Name: "fully qualified", DNSName: "pod-123.namespace-123.svc.cluster.local", Expected: true},
+		{Name: "end of the tier's lifetime", DNSName: "pod-123.namespace-123.svc", After: 34 * time.Minute, Expected: true},
+		{Name: "past the pod deadline", DNSName: "pod-123.namespace-123.svc", After: 36 * time.Minute, Expected: false},
+		{Name: "other instance", DNSName: "pod-456.namespace-123.svc", Expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := cert.Verify(x509.VerifyOptions{
+				Roots:       roots,
+				DNSName:     tc.DNSName,
+				CurrentTime: time.Now().Add(tc.After),
+			})
+			if (err == nil) != tc.Expected {
+				t.Errorf("Expected valid=%v, got %v", tc.Expected, err)
+			}
+		})
+	}
+
+	config.Pool = []trashdb.PoolConfig{{Tier: "small", Size: 1}}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected the pool to be refused with TLS")
+	}
+}
@@ -0,0 +1,142 @@
+package trashdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing uses the OpenTelemetry SDK with W3C trace context, so TrashDB's spans join the caller's
+// trace in any OpenTelemetry backend. Spans are batched and sent to an OTLP/HTTP receiver, or
+// written to stdout for local debugging.
+//
+// Every request gets a server span, with client spans for the Kubernetes calls made for it.
+// Kubernetes calls made by the event loop on its own aren't traced, they would drown out the rest.
+
+const tracerName = "github.com/taimoorgit/trashdb"
+
+// propagator reads the caller's traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// startSpan starts a child of the span in ctx, or a new trace if there is none. The tracer is
+// looked up every time so it follows the provider StartTracing (or a test) installs.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// endSpan finishes the span, a non-nil err marks it as failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// finishSpan is endSpan for deferring in functions with a named error result
+func finishSpan(span trace.Span, err *error) {
+	endSpan(span, *err)
+}
+
+// TraceID is the hex trace ID of the span in ctx, or "" outside a trace
+func TraceID(ctx context.Context) string {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		return spanContext.TraceID().String()
+	}
+	return ""
+}
+
+// TraceRequest wraps a handler in a server span that continues the caller's trace. The status
+// code is known when the handler is also wrapped by instrument.
+func TraceRequest(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := startSpan(ctx, r.Method+" "+route, trace.SpanKindServer)
+		span.SetAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.HTTPRoute(route),
+			semconv.ClientAddress(ClientIP(r)),
+		)
+
+		handler(w, r.WithContext(ctx))
+
+		var err error
+		if recorder, ok := w.(*statusRecorder); ok {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+			if recorder.status >= http.StatusInternalServerError {
+				err = fmt.Errorf("%s", http.StatusText(recorder.status))
+			}
+		}
+		endSpan(span, err)
+	}
+}
+
+// startClientSpan starts the span for a KubernetesClient call, only inside a trace
+func startClientSpan(ctx context.Context, method, namespace, name string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	ctx, span := startSpan(ctx, "KubernetesClient."+method, trace.SpanKindClient)
+	span.SetAttributes(semconv.K8SNamespaceName(namespace))
+	if name != "" {
+		span.SetAttributes(attribute.String("k8s.object.name", name))
+	}
+	return ctx, span
+}
+
+// StartTracing sets up the exporter from the config. The returned function flushes what is left,
+// call it before exiting.
+func StartTracing(c TracingConfig) func() {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(c.Endpoint, "/")+"/v1/traces"))
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return func() {}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("exporter", c.Exporter).Msg("Failed to set up tracing")
+		return func() {}
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(c.ServiceName)))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to merge tracing resource")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// traces the caller sampled are always recorded, new ones by the ratio
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	log.Info().Str("exporter", c.Exporter).Msg("Tracing enabled")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to flush spans")
+		}
+	}
+}
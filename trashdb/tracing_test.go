@@ -0,0 +1,117 @@
+package trashdb_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/taimoorgit/trashdb/trashdb"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// withSpanRecorder installs a tracer provider that keeps every span that ends
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	recorder := withSpanRecorder(t)
+
+	var inside string
+	handler := trashdb.TraceRequest("/pod_status", func(w http.ResponseWriter, r *http.Request) {
+		inside = trashdb.TraceID(r.Context())
+	})
+	request := httptest.NewRequest(http.MethodGet, "/pod_status", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the caller's trace ID, got %s", got)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !span.Parent().IsRemote() {
+		t.Errorf("Expected the caller's span as remote parent, got %s", got)
+	}
+	if span.SpanKind() != trace.SpanKindServer || span.Name() != "GET /pod_status" {
+		t.Errorf("Expected a GET /pod_status server span, got %s %s", span.SpanKind(), span.Name())
+	}
+	if inside != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the handler to see the caller's trace ID, got %q", inside)
+	}
+
+	// without a traceparent the request starts a trace of its own
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/pod_status", nil))
+	if spans := recorder.Ended(); len(spans) != 2 || spans[1].Parent().IsValid() {
+		t.Errorf("Expected a new root span, got %v", spans)
+	}
+}
+
+func TestKubernetesClientSpans(t *testing.T) {
+	recorder := withSpanRecorder(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-123", Namespace: "namespace-123"},
+		})
+	}))
+	t.Cleanup(server.Close)
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashdb.SetClient(clientset)
+	t.Cleanup(func() { trashdb.SetClient(nil) })
+	client := &trashdb.RealKubernetesClient{}
+
+	// calls outside a trace, like the event loop's, get no span
+	if _, err := client.GetPod(context.Background(), "namespace-123", "pod-123"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("Expected no spans outside a trace, got %d", len(spans))
+	}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	if _, err := client.GetPod(ctx, "namespace-123", "pod-123"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a client span and its parent, got %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "KubernetesClient.GetPod" || span.SpanKind() != trace.SpanKindClient {
+		t.Errorf("Expected a KubernetesClient.GetPod client span, got %s %s", span.SpanKind(), span.Name())
+	}
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected the client span to be a child of the request span")
+	}
+	attributes := map[string]string{}
+	for _, attribute := range span.Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["k8s.namespace.name"] != "namespace-123" || attributes["k8s.object.name"] != "pod-123" {
+		t.Errorf("Expected namespace and object attributes, got %v", attributes)
+	}
+}